@@ -6,8 +6,9 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -32,6 +33,29 @@ var (
 	space   = []byte{' '}
 )
 
+var (
+	// Running writePumps, waited for on shutdown so clients get their close
+	// frames.
+	writePumps sync.WaitGroup
+
+	// Set once shutdown starts; new connections are refused. admitMu orders
+	// it with writePumps.Add, so Wait never races an Add.
+	shuttingDown bool
+	admitMu      sync.Mutex
+)
+
+// admit counts a new connection's writePump unless shutdown started. The
+// caller must call writePumps.Done if it never starts the writePump.
+func admit() bool {
+	admitMu.Lock()
+	defer admitMu.Unlock()
+	if shuttingDown {
+		return false
+	}
+	writePumps.Add(1)
+	return true
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -46,6 +70,12 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Close frame sent once send is closed, set by the hub on shutdown.
+	closeFrame []byte
+
+	// Logger tagged with the connection ID.
+	log *slog.Logger
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -57,6 +87,8 @@ func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		connections.Dec()
+		c.log.Info("connection closed")
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -65,10 +97,12 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.log.Warn("unexpected close", "err", err)
 			}
 			break
 		}
+		messagesIn.Inc()
+		c.log.Debug("message received", "size", len(message))
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 		c.hub.broadcast <- message
 	}
@@ -84,6 +118,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		writePumps.Done()
 	}()
 	for {
 		select {
@@ -91,7 +126,7 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeFrame)
 				return
 			}
 
@@ -111,6 +146,7 @@ func (c *Client) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+			messagesOut.Add(float64(n + 1))
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -122,12 +158,21 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !admit() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	logger := connLogger(r.RemoteAddr)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		writePumps.Done()
+		upgradeErrors.Inc()
+		logger.Warn("upgrade failed", "err", err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	connections.Inc()
+	logger.Info("connection opened")
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), log: logger}
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -4,6 +4,8 @@
 
 package main
 
+import "github.com/gorilla/websocket"
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -18,6 +20,13 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Shutdown requests; the hub closes the channel sent once every client
+	// was told to close.
+	quit chan chan struct{}
+
+	// Set on shutdown; clients registering afterwards are closed at once.
+	closing bool
 }
 
 func newHub() *Hub {
@@ -25,6 +34,7 @@ func newHub() *Hub {
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		quit:       make(chan chan struct{}),
 		clients:    make(map[*Client]bool),
 	}
 }
@@ -33,6 +43,10 @@ func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
+			if h.closing {
+				h.closeClient(client)
+				continue
+			}
 			h.clients[client] = true
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
@@ -40,14 +54,54 @@ func (h *Hub) run() {
 				close(client.send)
 			}
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+			h.deliver(message)
+		case done := <-h.quit:
+			h.closeAll()
+			close(done)
 		}
 	}
 }
+
+func (h *Hub) deliver(message []byte) {
+	for client := range h.clients {
+		select {
+		case client.send <- message:
+		default:
+			sendDrops.Inc()
+			client.log.Warn("send buffer full, dropping client")
+			close(client.send)
+			delete(h.clients, client)
+		}
+	}
+}
+
+// stop tells every client to close with a going away close frame, after
+// delivering the messages already sent to the hub.
+func (h *Hub) stop() {
+	done := make(chan struct{})
+	h.quit <- done
+	<-done
+}
+
+func (h *Hub) closeAll() {
+	h.closing = true
+	for drained := false; !drained; {
+		select {
+		case message := <-h.broadcast:
+			h.deliver(message)
+		default:
+			drained = true
+		}
+	}
+	for client := range h.clients {
+		delete(h.clients, client)
+		h.closeClient(client)
+	}
+}
+
+// closeClient makes the client's writePump send the going away close frame
+// and exit.
+func (h *Hub) closeClient(client *Client) {
+	client.closeFrame = websocket.FormatCloseMessage(websocket.CloseGoingAway, reconnectHint)
+	close(client.send)
+}
@@ -0,0 +1,29 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// setupLogging makes a JSON logger on stderr the default for both slog and
+// the log package. Level is debug, info, warn or error.
+func setupLogging(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+var lastConnID atomic.Uint64
+
+// connLogger returns a logger tagging every line with a new connection ID.
+func connLogger(remoteAddr string) *slog.Logger {
+	return slog.With("conn", lastConnID.Add(1), "remote", remoteAddr)
+}
@@ -5,15 +5,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var addr = flag.String("addr", ":8080", "http service address")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "longest a shutdown waits for clients to close")
+var logLevel = flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+
+// Close reason sent to clients on shutdown.
+const reconnectHint = "server restarting, reconnect shortly"
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.URL)
+	slog.Debug("serving home", "url", r.URL.String())
 	if r.URL.Path != "/" {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -27,14 +40,58 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(*logLevel); err != nil {
+		slog.Error("invalid log level", "err", err)
+		os.Exit(2)
+	}
 	hub := newHub()
 	go hub.run()
 	http.HandleFunc("/", serveHome)
+	http.Handle("GET /metrics", promhttp.Handler())
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	srv := &http.Server{Addr: *addr}
+	go shutdownOnSignal(srv, hub)
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("ListenAndServe", "err", err)
+		os.Exit(1)
+	}
+	// shutdownOnSignal exits.
+	select {}
+}
+
+// shutdownOnSignal stops taking connections on SIGINT or SIGTERM, closes
+// every client with 1001 going away and exits once they are closed or the
+// shutdown timeout passed.
+func shutdownOnSignal(srv *http.Server, hub *Hub) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	slog.Info("shutting down")
+	admitMu.Lock()
+	shuttingDown = true
+	admitMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+		hub.stop()
+		writePumps.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		os.Exit(0)
+	case <-ctx.Done():
+		slog.Warn("shutdown timed out")
+	case <-stop:
 	}
+	os.Exit(1)
 }
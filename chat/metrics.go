@@ -0,0 +1,39 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics served on /metrics. The names match the other chat servers; this
+// one has a single room, labelled "", and no database or authentication.
+var (
+	connections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_connections",
+		Help: "Open websocket connections per room.",
+	}, []string{"room"}).WithLabelValues("")
+
+	messagesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_messages_received_total",
+		Help: "Frames read from clients.",
+	})
+
+	messagesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_messages_sent_total",
+		Help: "Messages written to clients.",
+	})
+
+	sendDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_send_buffer_drops_total",
+		Help: "Clients dropped because their send buffer was full.",
+	})
+
+	upgradeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_upgrade_errors_total",
+		Help: "Failed websocket handshakes.",
+	})
+)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Usernames given server-wide admin rights with -admins
+var admins = make(map[string]bool)
+
+func parseAdmins(list string) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins[strings.ToLower(name)] = true
+		}
+	}
+}
+
+// isAdmin reports whether the session belongs to a server admin. Usernames
+// are case-insensitive like in the users table.
+func isAdmin(s *session) bool {
+	return s != nil && admins[strings.ToLower(s.username)]
+}
+
+// requireAdmin authenticates an admin API request, writing the error response
+// if it is not allowed
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !isAdmin(s) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return s, true
+}
@@ -0,0 +1,47 @@
+// Package bus carries room traffic between server nodes, so clients of one
+// room connected to different nodes see each other. Every node publishes
+// what it delivers to its own clients and delivers what other nodes publish;
+// a node recognizes its own envelopes by their origin and skips them.
+package bus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned by Publish when envelopes are produced faster than the bus sends
+// them
+var ErrBacklog = errors.New("bus backlog full")
+
+// Envelope is one message on the bus. Data is opaque to the bus.
+type Envelope struct {
+	Origin string          `json:"origin"` // node ID of the publisher
+	Room   string          `json:"room,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Envelopes buffered per subscriber, and waiting to be sent
+const queueSize = 1024
+
+// Bus is a pub/sub channel shared by all nodes. Publish must not block on
+// the network. Subscribe returns a channel of every envelope published from
+// then on, including the node's own; Close closes it.
+type Bus interface {
+	Publish(e Envelope) error
+	Subscribe() (<-chan Envelope, error)
+	Close() error
+}
+
+// Open returns the bus described by spec: "local" for a single process, or a
+// redis:// URL
+func Open(spec string) (Bus, error) {
+	switch {
+	case spec == "local":
+		return NewLocal(), nil
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return DialRedis(spec, DefaultRedisPrefix)
+	}
+	return nil, fmt.Errorf("unknown bus %q", spec)
+}
@@ -0,0 +1,56 @@
+package bus
+
+import "sync"
+
+// Local is a bus within one process, for a single node or several hubs in
+// one binary
+type Local struct {
+	mu     sync.Mutex
+	subs   []chan Envelope
+	closed bool
+}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+// Subscribe adds a reader; every reader gets its own copy of each envelope
+func (l *Local) Subscribe() (<-chan Envelope, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan Envelope, queueSize)
+	if l.closed {
+		close(ch)
+	} else {
+		l.subs = append(l.subs, ch)
+	}
+	return ch, nil
+}
+
+// Publish hands e to every reader, failing for readers that fell behind
+func (l *Local) Publish(e Envelope) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+			err = ErrBacklog
+		}
+	}
+	return err
+}
+
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		for _, ch := range l.subs {
+			close(ch)
+		}
+		l.subs = nil
+	}
+	return nil
+}
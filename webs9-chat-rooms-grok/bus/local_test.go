@@ -0,0 +1,40 @@
+package bus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLocalFanOut(t *testing.T) {
+	l := NewLocal()
+	a, b := subscribe(t, l), subscribe(t, l)
+
+	if err := l.Publish(Envelope{Origin: "n1", Room: "public", Data: []byte("{}")}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, ch := range []<-chan Envelope{a, b} {
+		if e := receive(t, ch); e.Origin != "n1" || e.Room != "public" {
+			t.Errorf("got %+v", e)
+		}
+	}
+
+	l.Close()
+	if _, ok := <-a; ok {
+		t.Error("channel open after Close")
+	}
+	if _, ok := <-subscribe(t, l); ok {
+		t.Error("Subscribe after Close returned an open channel")
+	}
+}
+
+func TestLocalBacklog(t *testing.T) {
+	l := NewLocal()
+	subscribe(t, l)
+	var err error
+	for i := 0; i <= queueSize && err == nil; i++ {
+		err = l.Publish(Envelope{Origin: "n1"})
+	}
+	if !errors.Is(err, ErrBacklog) {
+		t.Errorf("Publish to a full reader: err = %v, want ErrBacklog", err)
+	}
+}
@@ -0,0 +1,138 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Channel name prefix; each room is published on the prefix followed by its
+// name
+const DefaultRedisPrefix = "webs9:room:"
+
+// Redis is a bus over Redis pub/sub. Envelopes are sent from a queue by a
+// goroutine of their own, so Publish never waits for Redis. Redis doesn't
+// keep pub/sub messages: a node misses what is published while it is
+// disconnected.
+type Redis struct {
+	client *redis.Client
+	prefix string
+
+	queue chan Envelope
+	sent  chan struct{} // closed once the queue is drained
+
+	mu     sync.Mutex
+	closed bool
+	subs   []*redis.PubSub
+}
+
+// DialRedis connects to the Redis server at url, such as
+// redis://localhost:6379/0
+func DialRedis(url, prefix string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	r := &Redis{
+		client: client,
+		prefix: prefix,
+		queue:  make(chan Envelope, queueSize),
+		sent:   make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *Redis) run() {
+	defer close(r.sent)
+	for e := range r.queue {
+		data, err := json.Marshal(e)
+		if err != nil {
+			slog.Error("Bus publish error", "room", e.Room, "err", err)
+			continue
+		}
+		if err := r.client.Publish(context.Background(), r.prefix+e.Room, data).Err(); err != nil {
+			slog.Error("Bus publish error", "room", e.Room, "err", err)
+		}
+	}
+}
+
+func (r *Redis) Publish(e Envelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return redis.ErrClosed
+	}
+	select {
+	case r.queue <- e:
+		return nil
+	default:
+		return ErrBacklog
+	}
+}
+
+// Subscribe listens to every room channel. Envelopes that don't decode are
+// logged and dropped.
+func (r *Redis) Subscribe() (<-chan Envelope, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ps := r.client.PSubscribe(ctx, r.prefix+"*")
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		ps.Close()
+		return nil, redis.ErrClosed
+	}
+	r.subs = append(r.subs, ps)
+	r.mu.Unlock()
+
+	out := make(chan Envelope, queueSize)
+	go func() {
+		defer close(out)
+		for msg := range ps.Channel(redis.WithChannelSize(queueSize)) {
+			var e Envelope
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				slog.Warn("Bus message dropped", "channel", msg.Channel, "err", err)
+				continue
+			}
+			out <- e
+		}
+	}()
+	return out, nil
+}
+
+// Close sends what is still queued, then ends the subscriptions
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	subs := r.subs
+	r.mu.Unlock()
+
+	<-r.sent
+	for _, ps := range subs {
+		ps.Close()
+	}
+	return r.client.Close()
+}
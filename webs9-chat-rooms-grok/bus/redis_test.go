@@ -0,0 +1,122 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func dialTest(t *testing.T, mr *miniredis.Miniredis, prefix string) *Redis {
+	t.Helper()
+	r, err := DialRedis("redis://"+mr.Addr(), prefix)
+	if err != nil {
+		t.Fatalf("DialRedis: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func subscribe(t *testing.T, b Bus) <-chan Envelope {
+	t.Helper()
+	ch, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan Envelope) Envelope {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no envelope received")
+		return Envelope{}
+	}
+}
+
+func expectNone(t *testing.T, ch <-chan Envelope) {
+	t.Helper()
+	select {
+	case e := <-ch:
+		t.Errorf("unexpected envelope %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := dialTest(t, mr, DefaultRedisPrefix), dialTest(t, mr, DefaultRedisPrefix)
+	fromA, fromB := subscribe(t, a), subscribe(t, b)
+
+	if err := a.Publish(Envelope{Origin: "a", Room: "public", Data: []byte(`{"n":1}`)}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	e := receive(t, fromB)
+	if e.Origin != "a" || e.Room != "public" || string(e.Data) != `{"n":1}` {
+		t.Errorf("other node got %+v", e)
+	}
+
+	// The publisher gets its own envelope back, with the origin it skips
+	// it by
+	if e := receive(t, fromA); e.Origin != "a" {
+		t.Errorf("own envelope came back from %q, want a", e.Origin)
+	}
+}
+
+func TestRedisKeepsOrder(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := dialTest(t, mr, DefaultRedisPrefix), dialTest(t, mr, DefaultRedisPrefix)
+	ch := subscribe(t, b)
+
+	rooms := []string{"one", "two", "one", ""}
+	for i, room := range rooms {
+		a.Publish(Envelope{Origin: "a", Room: room, Data: []byte{'1' + byte(i)}})
+	}
+	for i, room := range rooms {
+		if e := receive(t, ch); e.Room != room || e.Data[0] != '1'+byte(i) {
+			t.Errorf("envelope %d = %+v, want room %q", i, e, room)
+		}
+	}
+}
+
+func TestRedisPrefix(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ours := dialTest(t, mr, "chat:")
+	theirs := dialTest(t, mr, "other:")
+	ch := subscribe(t, ours)
+
+	theirs.Publish(Envelope{Origin: "x", Room: "public", Data: []byte("{}")})
+	expectNone(t, ch)
+
+	// Room names are channel suffixes, not patterns
+	ours.Publish(Envelope{Origin: "a", Room: "a*b", Data: []byte("{}")})
+	if e := receive(t, ch); e.Room != "a*b" {
+		t.Errorf("got room %q, want a*b", e.Room)
+	}
+
+	// Other publishers on our channels that don't send envelopes are dropped
+	mr.Publish("chat:public", "not json")
+	ours.Publish(Envelope{Origin: "a", Room: "public", Data: []byte("{}")})
+	if e := receive(t, ch); e.Origin != "a" {
+		t.Errorf("got %+v after an invalid message, want the next envelope", e)
+	}
+}
+
+func TestRedisCloseSendsQueued(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := dialTest(t, mr, DefaultRedisPrefix)
+	b := dialTest(t, mr, DefaultRedisPrefix)
+	ch := subscribe(t, b)
+
+	a.Publish(Envelope{Origin: "a", Room: "public", Data: []byte("{}")})
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	receive(t, ch)
+	if err := a.Publish(Envelope{Origin: "a", Room: "public", Data: []byte("{}")}); err == nil {
+		t.Error("Publish after Close succeeded")
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errSelfDM             = errors.New("can't message yourself")
+	errNoSuchConversation = errors.New("no such conversation")
+)
+
+// conversationID returns the DM conversation between two users, creating it
+// on first use. Each pair has one conversation, stored with the lower user
+// ID first.
+func conversationID(tx *sql.Tx, userID, otherID string) (int64, error) {
+	a, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	b, err := strconv.ParseInt(otherID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if a > b {
+		a, b = b, a
+	}
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO dm_conversations (user_a, user_b) VALUES (?, ?)", a, b); err != nil {
+		return 0, err
+	}
+	var id int64
+	err = tx.QueryRow("SELECT id FROM dm_conversations WHERE user_a = ? AND user_b = ?", a, b).Scan(&id)
+	return id, err
+}
+
+// sendDM stores a direct message from the sender to the user named to and
+// returns it ready for delivery. A retry with the same client_msg_id returns
+// the stored message with found set, so it is only acked again.
+func sendDM(from *session, to, content, clientMsgID string) (m Message, found bool, err error) {
+	toID, err := lookupUserID(to)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if toID == from.userID {
+		return Message{}, false, errSelfDM
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Message{}, false, err
+	}
+	defer tx.Rollback()
+
+	convID, err := conversationID(tx, from.userID, toID)
+	if err != nil {
+		return Message{}, false, err
+	}
+
+	m = Message{
+		Type:           "dm",
+		ConversationID: convID,
+		Username:       from.username,
+		To:             to,
+		Content:        content,
+		ClientMsgID:    clientMsgID,
+		userID:         from.userID,
+		toUserID:       toID,
+	}
+	if clientMsgID != "" {
+		err := tx.QueryRow("SELECT id, timestamp FROM dm_messages WHERE sender_id = ? AND client_msg_id = ?", from.userID, clientMsgID).
+			Scan(&m.ID, &m.Timestamp)
+		if err == nil {
+			return m, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return Message{}, false, err
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	res, err := tx.Exec("INSERT INTO dm_messages (conversation_id, sender_id, content, client_msg_id, timestamp) VALUES (?, ?, ?, ?, ?)",
+		convID, from.userID, content, nullIfEmpty(clientMsgID), now)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if m.ID, err = res.LastInsertId(); err != nil {
+		return Message{}, false, err
+	}
+	// The sender has read their own conversation up to here
+	if err := markDMRead(tx, convID, from.userID, m.ID); err != nil {
+		return Message{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Message{}, false, err
+	}
+
+	m.Timestamp = now.Format(time.RFC3339)
+	return m, false, nil
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// markDMRead moves userID's read marker in a conversation forward to upTo
+func markDMRead(ex execer, convID int64, userID string, upTo int64) error {
+	_, err := ex.Exec(`
+		INSERT INTO dm_reads (conversation_id, user_id, last_read_id) VALUES (?, ?, ?)
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET last_read_id = MAX(last_read_id, excluded.last_read_id)`,
+		convID, userID, upTo)
+	return err
+}
+
+// readDMs marks a conversation of userID read up to message upTo, or up to
+// its latest message if upTo is 0
+func readDMs(convID int64, userID string, upTo int64) error {
+	var latest sql.NullInt64
+	err := db.QueryRow(`
+		SELECT (SELECT MAX(id) FROM dm_messages WHERE conversation_id = c.id)
+		FROM dm_conversations c WHERE c.id = ? AND (c.user_a = ? OR c.user_b = ?)`, convID, userID, userID).Scan(&latest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNoSuchConversation
+	}
+	if err != nil {
+		return err
+	}
+	if upTo <= 0 || upTo > latest.Int64 {
+		upTo = latest.Int64
+	}
+	return markDMRead(db, convID, userID, upTo)
+}
+
+// conversation is one entry of the GET /dms list
+type conversation struct {
+	ID          int64   `json:"conversation_id"`
+	Username    string  `json:"username"`
+	LastMessage Message `json:"last_message"`
+	Unread      int     `json:"unread"`
+}
+
+// listConversations returns userID's conversations, most recent first
+func listConversations(userID string) ([]conversation, error) {
+	rows, err := db.Query(`
+		SELECT c.id, u.username, m.id, su.username, m.content, m.timestamp,
+			(SELECT COUNT(*) FROM dm_messages x
+			 WHERE x.conversation_id = c.id AND x.sender_id != ?
+			   AND x.id > COALESCE((SELECT last_read_id FROM dm_reads r WHERE r.conversation_id = c.id AND r.user_id = ?), 0))
+		FROM dm_conversations c
+		JOIN users u ON u.id = CASE WHEN c.user_a = ? THEN c.user_b ELSE c.user_a END
+		JOIN dm_messages m ON m.id = (SELECT MAX(id) FROM dm_messages WHERE conversation_id = c.id)
+		JOIN users su ON su.id = m.sender_id
+		WHERE c.user_a = ? OR c.user_b = ?
+		ORDER BY m.id DESC`, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	convs := []conversation{}
+	for rows.Next() {
+		var c conversation
+		m := &c.LastMessage
+		if err := rows.Scan(&c.ID, &c.Username, &m.ID, &m.Username, &m.Content, &m.Timestamp, &c.Unread); err != nil {
+			return nil, err
+		}
+		m.Type = "dm"
+		m.ConversationID = c.ID
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
+}
+
+// dmPage is one page of a conversation older than a cursor, like historyPage
+type dmPage struct {
+	ConversationID int64     `json:"conversation_id,omitempty"`
+	Messages       []Message `json:"messages"`
+	NextBefore     int64     `json:"next_before,omitempty"`
+}
+
+// loadDMPage returns messages between userID and the user named with, older
+// than the message with ID before (0 for the newest), in chronological order
+func loadDMPage(userID, with string, before int64, limit int) (dmPage, error) {
+	page := dmPage{Messages: []Message{}}
+	otherID, err := lookupUserID(with)
+	if err != nil {
+		return dmPage{}, err
+	}
+
+	err = db.QueryRow(`
+		SELECT id FROM dm_conversations
+		WHERE (user_a = ? AND user_b = ?) OR (user_a = ? AND user_b = ?)`, userID, otherID, otherID, userID).Scan(&page.ConversationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return page, nil
+	}
+	if err != nil {
+		return dmPage{}, err
+	}
+
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	limit = pageSize(limit)
+	rows, err := db.Query(`
+		SELECT m.id, u.username, m.content, m.timestamp FROM dm_messages m JOIN users u ON u.id = m.sender_id
+		WHERE m.conversation_id = ? AND m.id < ? ORDER BY m.id DESC LIMIT ?`, page.ConversationID, before, limit)
+	if err != nil {
+		return dmPage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := Message{Type: "dm", ConversationID: page.ConversationID}
+		if err := rows.Scan(&m.ID, &m.Username, &m.Content, &m.Timestamp); err != nil {
+			return dmPage{}, err
+		}
+		page.Messages = append(page.Messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return dmPage{}, err
+	}
+
+	// Reverse to chronological order
+	msgs := page.Messages
+	for i := len(msgs)/2 - 1; i >= 0; i-- {
+		opp := len(msgs) - 1 - i
+		msgs[i], msgs[opp] = msgs[opp], msgs[i]
+	}
+	if len(msgs) == limit {
+		page.NextBefore = msgs[0].ID
+	}
+	return page, nil
+}
+
+func dmErrorText(err error) string {
+	switch {
+	case errors.Is(err, errNoSuchUser), errors.Is(err, errSelfDM), errors.Is(err, errNoSuchConversation):
+		return err.Error()
+	default:
+		slog.Error("DB DM error", "err", err)
+		return "Internal error"
+	}
+}
+
+// sendDM handles a websocket "dm" and has the hub deliver it to both users
+func (c *Client) sendDM(msg Message) {
+	s := c.sess.Load()
+	if s == nil {
+		c.nack(msg, "auth_required", "Auth required")
+		return
+	}
+	if msg.To == "" {
+		c.nack(msg, "invalid", "Missing recipient")
+		return
+	}
+	if msg.Content == "" {
+		c.nack(msg, "invalid", "Empty message")
+		return
+	}
+	if len(msg.ClientMsgID) > maxClientMsgIDLen {
+		c.nack(msg, "invalid", "client_msg_id too long")
+		return
+	}
+	dm := Message{Type: "dm", Username: s.username, To: msg.To, Content: msg.Content, from: c, userID: s.userID}
+	if d := runFilters(&dm); d.Action == FilterReject {
+		c.nack(msg, d.Code, d.Reason)
+		return
+	}
+
+	m, found, err := sendDM(s, msg.To, dm.Content, msg.ClientMsgID)
+	if err != nil {
+		code := "invalid"
+		if !errors.Is(err, errNoSuchUser) && !errors.Is(err, errSelfDM) {
+			code = "persist_failed"
+		}
+		c.nack(msg, code, dmErrorText(err))
+		return
+	}
+	c.ack(m)
+	if !found {
+		hub.direct <- m
+	}
+}
+
+// readDMs handles a websocket "dm_read"
+func (c *Client) readDMs(convID, upTo int64) {
+	s := c.sess.Load()
+	if s == nil {
+		c.reply(Message{Type: "error", Content: "Auth required"})
+		return
+	}
+	if err := readDMs(convID, s.userID, upTo); err != nil {
+		c.reply(Message{Type: "error", ConversationID: convID, Content: dmErrorText(err)})
+	}
+}
+
+// deliverDM sends a direct message to every connection of its sender and
+// recipient, on every node
+func (h *Hub) deliverDM(m Message) {
+	h.deliverLocalDM(m)
+	h.share(busEvent{Kind: busDirect, Message: m, UserID: m.userID, ToUserID: m.toUserID})
+}
+
+// deliverLocalDM sends a direct message to the connections on this node
+func (h *Hub) deliverLocalDM(m Message) {
+	data := marshal(m)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, userID := range []string{m.userID, m.toUserID} {
+		for client := range h.users[userID] {
+			h.sendData(client, data)
+		}
+	}
+}
+
+// listDMsHandler serves GET /dms, the caller's conversations with their last
+// message and unread count
+func listDMsHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	convs, err := listConversations(s.userID)
+	if err != nil {
+		slog.Error("DB DM list error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"conversations": convs})
+}
+
+// dmHistoryHandler serves GET /dms/{username}/messages?before=<id>&limit=N
+func dmHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	var before int64
+	var limit int
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := loadDMPage(s.userID, r.PathValue("username"), before, limit)
+	if errors.Is(err, errNoSuchUser) {
+		http.Error(w, "No such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("DB DM history error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// readDMsHandler serves POST /dms/{id}/read?up_to=<id>, marking a
+// conversation read up to a message or entirely
+func readDMsHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	convID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	var upTo int64
+	if v := r.URL.Query().Get("up_to"); v != "" {
+		if upTo, err = strconv.ParseInt(v, 10, 64); err != nil || upTo < 0 {
+			http.Error(w, "Invalid up_to", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = readDMs(convID, s.userID, upTo)
+	if errors.Is(err, errNoSuchConversation) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("DB DM read error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
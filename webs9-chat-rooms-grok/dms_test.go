@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dm sends a direct message and returns its ack or nack
+func (c *wsClient) dm(to, content, clientMsgID string) Message {
+	c.t.Helper()
+	c.send(Message{Type: "dm", To: to, Content: content, ClientMsgID: clientMsgID})
+	for {
+		if m := c.nextOf("ack", "nack"); m.ClientMsgID == clientMsgID {
+			return m
+		}
+	}
+}
+
+func conversations(t *testing.T, u testUser) []conversation {
+	t.Helper()
+	code, body := api(t, "GET", "/dms", u.token, nil)
+	var resp struct {
+		Conversations []conversation `json:"conversations"`
+	}
+	if code != http.StatusOK || json.Unmarshal(body, &resp) != nil {
+		t.Fatalf("GET /dms: %d %s", code, body)
+	}
+	return resp.Conversations
+}
+
+func TestDirectMessages(t *testing.T) {
+	alice, bob, carol := newUser(t), newUser(t), newUser(t)
+	ac, ac2 := dial(t, publicRoom, alice), dial(t, publicRoom, alice)
+	bc, cc := dial(t, publicRoom, bob), dial(t, publicRoom, carol)
+
+	id := uniqueName("c")
+	ack := ac.dm(bob.name, "hi bob", id)
+	if ack.Type != "ack" || ack.ID == 0 {
+		t.Fatalf("ack = %+v", ack)
+	}
+	// Both users get it on all of their connections
+	for _, c := range []*wsClient{bc, ac2} {
+		if m := c.next("dm"); m.ID != ack.ID || m.Username != alice.name || m.To != bob.name || m.ConversationID == 0 {
+			t.Errorf("dm = %+v", m)
+		}
+	}
+	cc.none("dm", 100*time.Millisecond)
+
+	// A retry is acked again but not delivered twice
+	if again := ac.dm(bob.name, "hi bob", id); again.ID != ack.ID {
+		t.Errorf("retry acked as %d, want %d", again.ID, ack.ID)
+	}
+	bc.none("dm", 100*time.Millisecond)
+
+	for _, to := range []string{alice.name, uniqueName("nobody"), ""} {
+		if m := ac.dm(to, "x", uniqueName("c")); m.Type != "nack" || m.Code != "invalid" {
+			t.Errorf("dm to %q: %+v, want an invalid nack", to, m)
+		}
+	}
+}
+
+func TestDMHistoryAndUnread(t *testing.T) {
+	alice, bob, carol := newUser(t), newUser(t), newUser(t)
+	ac := dial(t, publicRoom, alice)
+	var ids []int64
+	for i := range 3 {
+		ids = append(ids, ac.dm(bob.name, fmt.Sprint("dm ", i), uniqueName("c")).ID)
+	}
+
+	convs := conversations(t, bob)
+	if len(convs) != 1 || convs[0].Username != alice.name || convs[0].Unread != 3 || convs[0].LastMessage.ID != ids[2] {
+		t.Fatalf("bob's conversations = %+v", convs)
+	}
+	if convs := conversations(t, alice); len(convs) != 1 || convs[0].Unread != 0 {
+		t.Errorf("sender's conversations = %+v, want nothing unread", convs)
+	}
+	convID := convs[0].ID
+
+	code, body := api(t, "GET", fmt.Sprintf("/dms/%s/messages?limit=2&before=%d", alice.name, ids[2]), bob.token, nil)
+	var page dmPage
+	if code != http.StatusOK || json.Unmarshal(body, &page) != nil || len(page.Messages) != 2 || page.Messages[0].ID != ids[0] || page.NextBefore != ids[0] {
+		t.Errorf("DM page: %d %s", code, body)
+	}
+
+	path := fmt.Sprintf("/dms/%d/read?up_to=%d", convID, ids[0])
+	if code, _ := api(t, "POST", path, bob.token, nil); code != http.StatusNoContent {
+		t.Errorf("POST %s: %d", path, code)
+	}
+	if convs := conversations(t, bob); convs[0].Unread != 2 {
+		t.Errorf("unread after reading one: %d, want 2", convs[0].Unread)
+	}
+	bc := dial(t, publicRoom, bob)
+	bc.send(Message{Type: "dm_read", ConversationID: convID})
+	bc.sync(publicRoom)
+	if convs := conversations(t, bob); convs[0].Unread != 0 {
+		t.Errorf("unread after dm_read: %d, want 0", convs[0].Unread)
+	}
+
+	if code, _ := api(t, "POST", fmt.Sprintf("/dms/%d/read", convID), carol.token, nil); code != http.StatusNotFound {
+		t.Errorf("reading another pair's conversation: %d, want 404", code)
+	}
+	if code, _ := api(t, "GET", "/dms/"+uniqueName("nobody")+"/messages", bob.token, nil); code != http.StatusNotFound {
+		t.Errorf("DMs with an unknown user: %d, want 404", code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"webs9-chat-db/store"
+)
+
+var (
+	errNoSuchMessage  = errors.New("no such message")
+	errMessageDeleted = errors.New("message was deleted")
+)
+
+// authorizeChange loads a message and checks that actor may edit or delete
+// it: the author while still allowed to post, or a moderator of the room
+func authorizeChange(id int64, actor *session) (store.Message, error) {
+	m, err := messageStore.Get(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return store.Message{}, errNoSuchMessage
+	}
+	if err != nil {
+		return store.Message{}, err
+	}
+	if m.Deleted {
+		return store.Message{}, errMessageDeleted
+	}
+
+	r, err := roleOf(m.Room, actor.userID)
+	if err != nil {
+		return store.Message{}, err
+	}
+	isAuthor := m.UserID != "" && m.UserID == actor.userID
+	if !(isAuthor && r.canWrite()) && r < roleModerator {
+		return store.Message{}, errForbidden
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of a message, keeping the previous
+// version in message_edits
+func editMessage(id int64, actor *session, content string) (Message, error) {
+	sm, err := authorizeChange(id, actor)
+	if err != nil {
+		return Message{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	_, err = db.Exec("INSERT INTO message_edits (message_id, content, edited_by, edited_at) VALUES (?, ?, ?, ?)",
+		id, sm.Content, actor.userID, now)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := messageStore.Edit(id, content, now); err != nil {
+		return Message{}, err
+	}
+
+	m := changedMessage(sm)
+	m.Type = "message_updated"
+	m.Content = content
+	m.EditedAt = now.Format(time.RFC3339)
+	m.Timestamp = m.EditedAt
+	return m, nil
+}
+
+// deleteMessage turns a message into a tombstone. Its content, earlier
+// versions and reactions are removed; the message stays so seqs and reply references hold.
+func deleteMessage(id int64, actor *session) (Message, error) {
+	sm, err := authorizeChange(id, actor)
+	if err != nil {
+		return Message{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := messageStore.Delete(id, now); err != nil {
+		return Message{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id = ?", id); err != nil {
+		return Message{}, err
+	}
+	if _, err := tx.Exec("DELETE FROM reactions WHERE message_id = ?", id); err != nil {
+		return Message{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	m := changedMessage(sm)
+	m.Type = "message_deleted"
+	m.Deleted = true
+	m.Timestamp = now.Format(time.RFC3339)
+	return m, nil
+}
+
+// changedMessage is the part of a stored message sent with change events
+func changedMessage(sm store.Message) Message {
+	return Message{ID: sm.ID, Room: sm.Room, Seq: sm.Seq, Username: sm.Username, ParentID: sm.ParentID}
+}
+
+func changeErrorText(err error) string {
+	switch {
+	case errors.Is(err, errNoSuchMessage), errors.Is(err, errMessageDeleted), errors.Is(err, errForbidden):
+		return err.Error()
+	default:
+		slog.Error("DB message change error", "err", err)
+		return "Internal error"
+	}
+}
+
+// editMessage handles a websocket "edit" and tells the room
+func (c *Client) editMessage(id int64, content string) {
+	s := c.sess.Load()
+	if s == nil {
+		c.reply(Message{Type: "error", Content: "Auth required"})
+		return
+	}
+	if content == "" {
+		c.reply(Message{Type: "error", Content: "Empty message"})
+		return
+	}
+	edit := Message{Type: "edit", ID: id, Username: s.username, Content: content, from: c, userID: s.userID}
+	if d := runFilters(&edit); d.Action == FilterReject {
+		c.reply(Message{Type: "error", ID: id, Code: d.Code, Content: d.Reason})
+		return
+	}
+
+	m, err := editMessage(id, s, edit.Content)
+	if err != nil {
+		c.reply(Message{Type: "error", ID: id, Content: changeErrorText(err)})
+		return
+	}
+	hub.notify <- m
+}
+
+// deleteMessage handles a websocket "delete" and tells the room
+func (c *Client) deleteMessage(id int64) {
+	s := c.sess.Load()
+	if s == nil {
+		c.reply(Message{Type: "error", Content: "Auth required"})
+		return
+	}
+
+	m, err := deleteMessage(id, s)
+	if err != nil {
+		c.reply(Message{Type: "error", ID: id, Content: changeErrorText(err)})
+		return
+	}
+	hub.notify <- m
+}
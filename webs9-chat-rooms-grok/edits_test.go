@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestEditMessage(t *testing.T) {
+	owner, author, other := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, author, "member")
+	addMember(t, room, owner, other, "member")
+	ac, oc := dial(t, room, author), dial(t, room, other)
+	ack := ac.chat("first draft")
+
+	oc.send(Message{Type: "edit", ID: ack.ID, Content: "not mine"})
+	if m := oc.next("error"); m.ID != ack.ID || m.Content != errForbidden.Error() {
+		t.Errorf("edit by another member: %+v, want forbidden", m)
+	}
+
+	ac.send(Message{Type: "edit", ID: ack.ID, Content: "final"})
+	m := oc.next("message_updated")
+	if m.ID != ack.ID || m.Seq != ack.Seq || m.Content != "final" || m.EditedAt == "" {
+		t.Errorf("message_updated = %+v", m)
+	}
+
+	msgs, err := getMessagesBefore(room, 0, 1)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "final" || msgs[0].EditedAt == "" {
+		t.Errorf("history after edit = %+v, %v", msgs, err)
+	}
+	var previous string
+	if err := db.QueryRow("SELECT content FROM message_edits WHERE message_id = ?", ack.ID).Scan(&previous); err != nil || previous != "first draft" {
+		t.Errorf("previous version = %q, %v", previous, err)
+	}
+
+	ac.send(Message{Type: "edit", ID: ack.ID})
+	if m := ac.next("error"); m.Content != "Empty message" {
+		t.Errorf("empty edit: %+v", m)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	owner, author := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, author, "member")
+	ac, oc := dial(t, room, author), dial(t, room, owner)
+	ack := ac.chat("regrettable")
+	ac.send(Message{Type: "edit", ID: ack.ID, Content: "still regrettable"})
+	oc.next("message_updated")
+
+	// Owners and moderators delete anyone's messages
+	oc.send(Message{Type: "delete", ID: ack.ID})
+	if m := ac.next("message_deleted"); m.ID != ack.ID || !m.Deleted {
+		t.Errorf("message_deleted = %+v", m)
+	}
+
+	msgs, err := getMessagesBefore(room, 0, 1)
+	if err != nil || len(msgs) != 1 || !msgs[0].Deleted || msgs[0].Content != "" || msgs[0].Seq != ack.Seq {
+		t.Errorf("tombstone = %+v, %v", msgs, err)
+	}
+	var edits int
+	db.QueryRow("SELECT COUNT(*) FROM message_edits WHERE message_id = ?", ack.ID).Scan(&edits)
+	if edits != 0 {
+		t.Errorf("%d earlier versions kept after delete", edits)
+	}
+
+	for _, m := range []Message{{Type: "edit", ID: ack.ID, Content: "x"}, {Type: "delete", ID: ack.ID}} {
+		ac.send(m)
+		if got := ac.next("error"); got.Content != errMessageDeleted.Error() {
+			t.Errorf("%s of a deleted message: %+v", m.Type, got)
+		}
+	}
+	ac.send(Message{Type: "delete", ID: 1 << 40})
+	if got := ac.next("error"); got.Content != errNoSuchMessage.Error() {
+		t.Errorf("delete of an unknown message: %+v", got)
+	}
+}
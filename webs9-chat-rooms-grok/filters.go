@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilterAction is what a filter decided about a message
+type FilterAction int
+
+const (
+	FilterAllow  FilterAction = iota
+	FilterFlag                // let through, but log it for moderators
+	FilterReject              // send back to the sender as a nack
+)
+
+func (a FilterAction) String() string {
+	switch a {
+	case FilterFlag:
+		return "flagged"
+	case FilterReject:
+		return "rejected"
+	}
+	return "allowed"
+}
+
+// FilterDecision is a filter's verdict. Code is sent to the sender as the
+// machine-readable reason of a rejection.
+type FilterDecision struct {
+	Action FilterAction
+	Code   string
+	Reason string
+}
+
+// MessageFilter inspects user-written content (chat messages, edits and
+// DMs) before it is stored and delivered. Filters may rewrite m.Content in
+// place. They run on readPump goroutines, so they must be safe for
+// concurrent use.
+type MessageFilter interface {
+	Name() string
+	Filter(m *Message) FilterDecision
+}
+
+// The filter chain, set up from flags in main
+var filters []MessageFilter
+
+// runFilters passes m through the chain, stopping at the first rejection.
+// Every decision other than a plain allow is logged.
+func runFilters(m *Message) FilterDecision {
+	result := FilterDecision{Action: FilterAllow}
+	for _, f := range filters {
+		before := m.Content
+		d := f.Filter(m)
+		if d.Action != FilterAllow || m.Content != before {
+			action := d.Action.String()
+			if d.Action == FilterAllow {
+				action = "rewrote"
+			}
+			logger := slog.Default()
+			if m.from != nil {
+				logger = m.from.log
+			}
+			logger.Info("Filter decision", "filter", f.Name(), "action", action, "type", m.Type, "user", m.Username, "room", m.Room, "reason", d.Reason)
+		}
+		switch d.Action {
+		case FilterReject:
+			return d
+		case FilterFlag:
+			result = d
+		}
+	}
+	return result
+}
+
+// maxLengthFilter rejects content longer than max characters
+type maxLengthFilter struct {
+	max int
+}
+
+func (f maxLengthFilter) Name() string { return "max_length" }
+
+func (f maxLengthFilter) Filter(m *Message) FilterDecision {
+	if utf8.RuneCountInString(m.Content) > f.max {
+		return FilterDecision{Action: FilterReject, Code: "too_long", Reason: fmt.Sprintf("Message longer than %d characters", f.max)}
+	}
+	return FilterDecision{}
+}
+
+// bannedWordsFilter masks, rejects or flags content containing listed words,
+// matched case-insensitively as whole words
+type bannedWordsFilter struct {
+	pattern *regexp.Regexp
+	action  string // mask, reject or flag
+}
+
+// loadBannedWords reads a word list with one word or phrase per line; empty
+// lines and lines starting with # are skipped
+func loadBannedWords(path, action string) (*bannedWordsFilter, error) {
+	switch action {
+	case "mask", "reject", "flag":
+	default:
+		return nil, fmt.Errorf("banned words action %q must be mask, reject or flag", action)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s: no banned words", path)
+	}
+	return &bannedWordsFilter{
+		pattern: regexp.MustCompile(`(?i)(` + strings.Join(words, "|") + `)(?:$|[^\p{L}\p{N}_])`),
+		action:  action,
+	}, nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// find returns where banned words stand as whole words in s, not next to a
+// letter, digit or underscore of any script; Go's \b only knows ASCII. The
+// pattern checks what follows a word, and find what precedes it, since
+// RE2 has no lookbehind.
+func (f *bannedWordsFilter) find(s string) [][2]int {
+	var spans [][2]int
+	for pos := 0; pos < len(s); {
+		loc := f.pattern.FindStringSubmatchIndex(s[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[2], pos+loc[3]
+		if before, _ := utf8.DecodeLastRuneInString(s[:start]); start > 0 && isWordRune(before) {
+			_, size := utf8.DecodeRuneInString(s[start:])
+			pos = start + size
+			continue
+		}
+		spans = append(spans, [2]int{start, end})
+		// The boundary after the word may start the next one
+		pos = max(end, start+1)
+	}
+	return spans
+}
+
+func (f *bannedWordsFilter) Name() string { return "banned_words" }
+
+func (f *bannedWordsFilter) Filter(m *Message) FilterDecision {
+	spans := f.find(m.Content)
+	if len(spans) == 0 {
+		return FilterDecision{}
+	}
+	switch f.action {
+	case "reject":
+		return FilterDecision{Action: FilterReject, Code: "banned_word", Reason: "Message contains a banned word"}
+	case "flag":
+		return FilterDecision{Action: FilterFlag, Code: "banned_word", Reason: "Message contains a banned word"}
+	}
+	var masked strings.Builder
+	last := 0
+	for _, span := range spans {
+		masked.WriteString(m.Content[last:span[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(m.Content[span[0]:span[1]])))
+		last = span[1]
+	}
+	masked.WriteString(m.Content[last:])
+	m.Content = masked.String()
+	return FilterDecision{Reason: "masked banned words"}
+}
+
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// urlAllowlistFilter rejects links to hosts outside the allowlist.
+// Subdomains of allowed hosts are allowed too.
+type urlAllowlistFilter struct {
+	hosts []string
+}
+
+func parseURLAllowlist(list string) *urlAllowlistFilter {
+	f := &urlAllowlistFilter{}
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			f.hosts = append(f.hosts, host)
+		}
+	}
+	return f
+}
+
+func (f *urlAllowlistFilter) Name() string { return "url_allowlist" }
+
+func (f *urlAllowlistFilter) allowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range f.hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *urlAllowlistFilter) Filter(m *Message) FilterDecision {
+	for _, link := range urlPattern.FindAllString(m.Content, -1) {
+		if !f.allowed(link) {
+			return FilterDecision{Action: FilterReject, Code: "url_not_allowed", Reason: "Links to " + link + " are not allowed"}
+		}
+	}
+	return FilterDecision{}
+}
+
+// spamFilter rejects a chat message when its sender already sent the same
+// text repeats times within window
+type spamFilter struct {
+	repeats int
+	window  time.Duration
+
+	mu     sync.Mutex
+	recent map[string][]sentText // by user ID, or IP for anonymous senders
+}
+
+type sentText struct {
+	text string
+	at   time.Time
+}
+
+func newSpamFilter(repeats int, window time.Duration) *spamFilter {
+	f := &spamFilter{repeats: repeats, window: window, recent: make(map[string][]sentText)}
+	go f.sweep()
+	return f
+}
+
+func (f *spamFilter) Name() string { return "repeat_spam" }
+
+func (f *spamFilter) Filter(m *Message) FilterDecision {
+	if m.Type != "message" {
+		return FilterDecision{}
+	}
+	key := m.userID
+	if key == "" && m.from != nil {
+		key = "ip:" + m.from.ip
+	}
+	text := strings.ToLower(strings.Join(strings.Fields(m.Content), " "))
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kept := f.recent[key][:0]
+	same := 0
+	for _, s := range f.recent[key] {
+		if now.Sub(s.at) > f.window {
+			continue
+		}
+		kept = append(kept, s)
+		if s.text == text {
+			same++
+		}
+	}
+	if same >= f.repeats {
+		f.recent[key] = kept
+		return FilterDecision{Action: FilterReject, Code: "spam", Reason: "Same message sent too often"}
+	}
+	f.recent[key] = append(kept, sentText{text: text, at: now})
+	return FilterDecision{}
+}
+
+// sweep forgets senders with nothing sent inside the window
+func (f *spamFilter) sweep() {
+	for range time.Tick(f.window) {
+		now := time.Now()
+		f.mu.Lock()
+		for key, sent := range f.recent {
+			if len(sent) == 0 || now.Sub(sent[len(sent)-1].at) > f.window {
+				delete(f.recent, key)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bannedWords(t *testing.T, action string, words ...string) *bannedWordsFilter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "words")
+	list := "# comment\n\n" + strings.Join(words, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadBannedWords(path, action)
+	if err != nil {
+		t.Fatalf("loadBannedWords: %v", err)
+	}
+	return f
+}
+
+func TestBannedWordsMask(t *testing.T) {
+	f := bannedWords(t, "mask", "darn", "bad phrase", "café", "c++")
+	cases := map[string]string{
+		"Darn it":                  "**** it",
+		"darn, DARN!":              "****, ****!",
+		"darning and undarn":       "darning and undarn",
+		"darn_it or it_darn":       "darn_it or it_darn",
+		"ädarn and darnö":          "ädarn and darnö",
+		"日本darn":                   "日本darn",
+		"darn darn":                "**** ****",
+		"a bad phrase here":        "a ********** here",
+		"Café, cafés":              "****, cafés",
+		"I like c++.":              "I like ***.",
+		"nothing to see":           "nothing to see",
+		"«darn»":                   "«****»",
+		" darn ":                   " **** ",
+		"naïvedarn but naïve darn": "naïvedarn but naïve ****",
+	}
+	for in, want := range cases {
+		m := &Message{Content: in}
+		if d := f.Filter(m); d.Action != FilterAllow || m.Content != want {
+			t.Errorf("Filter(%q) = %q, %v, want %q", in, m.Content, d.Action, want)
+		}
+	}
+}
+
+func TestBannedWordsActions(t *testing.T) {
+	for action, want := range map[string]FilterAction{"reject": FilterReject, "flag": FilterFlag} {
+		f := bannedWords(t, action, "darn")
+		m := &Message{Content: "oh darn"}
+		if d := f.Filter(m); d.Action != want || d.Code != "banned_word" || m.Content != "oh darn" {
+			t.Errorf("%s: %+v, content %q", action, d, m.Content)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "words")
+	os.WriteFile(path, []byte("# only comments\n"), 0o600)
+	if _, err := loadBannedWords(path, "mask"); err == nil {
+		t.Error("empty word list loaded")
+	}
+	if _, err := loadBannedWords(path, "delete"); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	f := maxLengthFilter{max: 5}
+	for content, want := range map[string]FilterAction{"ééééé": FilterAllow, "éééééé": FilterReject, "": FilterAllow} {
+		if d := f.Filter(&Message{Content: content}); d.Action != want {
+			t.Errorf("%d runes: %v, want %v", len([]rune(content)), d.Action, want)
+		}
+	}
+}
+
+func TestURLAllowlist(t *testing.T) {
+	f := parseURLAllowlist(" Example.com, ,docs.test")
+	cases := map[string]FilterAction{
+		"see https://example.com/x":        FilterAllow,
+		"www.sub.example.com/page":         FilterAllow,
+		"http://docs.test and no others":   FilterAllow,
+		"http://evil.com":                  FilterReject,
+		"http://badexample.com":            FilterReject,
+		"https://example.com.evil.com/":    FilterReject,
+		"ok https://example.com, http://x": FilterReject,
+		"no links at all":                  FilterAllow,
+	}
+	for content, want := range cases {
+		if d := f.Filter(&Message{Content: content}); d.Action != want {
+			t.Errorf("%q: %v, want %v", content, d.Action, want)
+		}
+	}
+}
+
+func TestSpamFilter(t *testing.T) {
+	f := &spamFilter{repeats: 2, window: time.Minute, recent: make(map[string][]sentText)}
+	send := func(userID, content string) FilterAction {
+		return f.Filter(&Message{Type: "message", userID: userID, Content: content}).Action
+	}
+	send("1", "buy now")
+	send("1", "Buy  NOW")
+	if got := send("1", " buy now "); got != FilterReject {
+		t.Errorf("third repeat: %v, want rejected", got)
+	}
+	if got := send("2", "buy now"); got != FilterAllow {
+		t.Errorf("another user: %v, want allowed", got)
+	}
+	if d := f.Filter(&Message{Type: "dm", userID: "1", Content: "buy now"}); d.Action != FilterAllow {
+		t.Errorf("DM: %v, want allowed", d.Action)
+	}
+}
+
+// setFilters replaces the filter chain for the rest of the test
+func setFilters(t *testing.T, chain ...MessageFilter) {
+	prev := filters
+	filters = chain
+	t.Cleanup(func() { filters = prev })
+}
+
+func TestRunFilters(t *testing.T) {
+	setFilters(t, bannedWords(t, "flag", "darn"), maxLengthFilter{max: 10}, bannedWords(t, "mask", "heck"))
+
+	m := &Message{Content: "darn heck"}
+	if d := runFilters(m); d.Action != FilterFlag || m.Content != "darn ****" {
+		t.Errorf("flagged message: %+v, %q", d, m.Content)
+	}
+	m = &Message{Content: "darn it, heck"}
+	if d := runFilters(m); d.Action != FilterReject || d.Code != "too_long" || m.Content != "darn it, heck" {
+		t.Errorf("long message: %+v, %q, want rejected before masking", d, m.Content)
+	}
+}
+
+func TestFiltersOnFrames(t *testing.T) {
+	u, other := newUser(t), newUser(t)
+	c, oc := dial(t, publicRoom, u), dial(t, publicRoom, other)
+	setFilters(t, maxLengthFilter{max: 20}, bannedWords(t, "mask", "darn"))
+
+	if m := c.chat("oh darn"); m.Type != "ack" {
+		t.Fatalf("message: %+v", m)
+	}
+	oc.message("oh ****")
+	m := c.chat(strings.Repeat("x", 21))
+	if m.Type != "nack" || m.Code != "too_long" {
+		t.Errorf("long message: %+v, want a too_long nack", m)
+	}
+
+	id := c.chat("fine").ID
+	c.send(Message{Type: "edit", ID: id, Content: "darn it"})
+	if m := oc.next("message_updated"); m.Content != "**** it" {
+		t.Errorf("edit delivered as %q", m.Content)
+	}
+	c.send(Message{Type: "edit", ID: id, Content: strings.Repeat("x", 21)})
+	if m := c.next("error"); m.Code != "too_long" {
+		t.Errorf("long edit: %+v", m)
+	}
+
+	if m := c.dm(other.name, "darn", uniqueName("c")); m.Type != "ack" {
+		t.Fatalf("DM: %+v", m)
+	}
+	if m := oc.next("dm"); m.Content != "****" {
+		t.Errorf("DM delivered as %q", m.Content)
+	}
+	if m := c.dm(other.name, strings.Repeat("x", 21), uniqueName("c")); m.Code != "too_long" {
+		t.Errorf("long DM: %+v", m)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+func pageSize(limit int) int {
+	switch {
+	case limit <= 0:
+		return defaultPageSize
+	case limit > maxPageSize:
+		return maxPageSize
+	}
+	return limit
+}
+
+// historyPage is one page of messages older than a cursor. NextBefore is the
+// cursor for the following page, 0 once the start of the room is reached.
+type historyPage struct {
+	Room       string    `json:"room"`
+	Messages   []Message `json:"messages"`
+	NextBefore int64     `json:"next_before,omitempty"`
+}
+
+func loadHistoryPage(room string, before int64, limit int) (historyPage, error) {
+	limit = pageSize(limit)
+	msgs, err := getMessagesBefore(room, before, limit)
+	if err != nil {
+		return historyPage{}, err
+	}
+
+	page := historyPage{Room: room, Messages: msgs}
+	if page.Messages == nil {
+		page.Messages = []Message{}
+	}
+	if len(msgs) == limit {
+		page.NextBefore = msgs[0].ID
+	}
+	return page, nil
+}
+
+// sendHistoryPage answers a websocket "history" request for room
+func (c *Client) sendHistoryPage(room string, before int64, limit int) {
+	if !clientRole(c, room).canRead() {
+		c.reply(Message{Type: "error", Content: "Not allowed to read this room"})
+		return
+	}
+
+	page, err := loadHistoryPage(room, before, limit)
+	if err != nil {
+		slog.Error("DB history error", "err", err)
+		c.reply(Message{Type: "error", Content: "Could not load history"})
+		return
+	}
+	c.reply(Message{
+		Type:      "history",
+		Room:      room,
+		Messages:  page.Messages,
+		Before:    page.NextBefore,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// historyHandler serves GET /rooms/{room}/messages?before=<id>&limit=N. The
+// public room needs no token.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+
+	userID := ""
+	if room != publicRoom {
+		s, err := sessionFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = s.userID
+	}
+	if rl, err := roleOf(room, userID); err != nil || !rl.canRead() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	var before int64
+	var limit int
+	var err error
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := loadHistoryPage(room, before, limit)
+	if err != nil {
+		slog.Error("DB history error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestPageSize(t *testing.T) {
+	for limit, want := range map[int]int{-1: defaultPageSize, 0: defaultPageSize, 1: 1, maxPageSize: maxPageSize, maxPageSize + 1: maxPageSize} {
+		if got := pageSize(limit); got != want {
+			t.Errorf("pageSize(%d) = %d, want %d", limit, got, want)
+		}
+	}
+}
+
+// postN sends n messages to the client's room and returns their contents
+func postN(t *testing.T, c *wsClient, n int) []string {
+	t.Helper()
+	var sent []string
+	for i := range n {
+		content := fmt.Sprintf("message %d", i)
+		if m := c.chat(content); m.Type != "ack" {
+			t.Fatalf("%s: %+v", content, m)
+		}
+		sent = append(sent, content)
+	}
+	return sent
+}
+
+func TestHistoryPages(t *testing.T) {
+	owner := newUser(t)
+	room := newRoom(t, owner)
+	sent := postN(t, dial(t, room, owner), 5)
+
+	// Pages come newest first, each in chronological order
+	var got []string
+	path := "/rooms/" + room + "/messages?limit=2"
+	for pages := 0; ; pages++ {
+		code, body := api(t, "GET", path, owner.token, nil)
+		var page historyPage
+		if code != http.StatusOK || json.Unmarshal(body, &page) != nil {
+			t.Fatalf("%s: %d %s", path, code, body)
+		}
+		var contents []string
+		for _, m := range page.Messages {
+			contents = append(contents, m.Content)
+		}
+		got = append(contents, got...)
+		if page.NextBefore == 0 {
+			if pages != 2 {
+				t.Errorf("%d pages, want 3", pages+1)
+			}
+			break
+		}
+		path = fmt.Sprintf("/rooms/%s/messages?limit=2&before=%d", room, page.NextBefore)
+	}
+	if !slices.Equal(got, sent) {
+		t.Errorf("history = %q, want %q", got, sent)
+	}
+
+	for _, q := range []string{"before=-1", "before=x", "limit=-1", "limit=x"} {
+		if code, _ := api(t, "GET", "/rooms/"+room+"/messages?"+q, owner.token, nil); code != http.StatusBadRequest {
+			t.Errorf("?%s: %d, want 400", q, code)
+		}
+	}
+	if code, _ := api(t, "GET", "/rooms/"+room+"/messages", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("private room without a token: %d, want 401", code)
+	}
+	if code, _ := api(t, "GET", "/rooms/"+publicRoom+"/messages", "", nil); code != http.StatusOK {
+		t.Errorf("%s without a token: %d, want 200", publicRoom, code)
+	}
+}
+
+func TestHistoryFrame(t *testing.T) {
+	owner := newUser(t)
+	room := newRoom(t, owner)
+	c := dial(t, room, owner)
+	sent := postN(t, c, 3)
+
+	c.send(Message{Type: "history", Room: room, Limit: 2})
+	m := c.next("history")
+	if len(m.Messages) != 2 || m.Messages[1].Content != sent[2] || m.Before == 0 {
+		t.Fatalf("first page = %+v", m)
+	}
+	c.send(Message{Type: "history", Room: room, Limit: 2, Before: m.Before})
+	m = c.next("history")
+	if len(m.Messages) != 1 || m.Messages[0].Content != sent[0] || m.Before != 0 {
+		t.Errorf("last page = %+v", m)
+	}
+
+	outsider := dialRaw(t, room, newUser(t))
+	outsider.send(Message{Type: "history", Room: room})
+	if m := outsider.nextOf("history", "error"); m.Type != "error" {
+		t.Errorf("outsider got %+v, want an error", m)
+	}
+}
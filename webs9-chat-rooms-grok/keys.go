@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How often the key directory is re-read so rotated keys are picked up
+const keyReloadInterval = time.Minute
+
+var validSigningMethods = []string{"RS256", "ES256", "EdDSA"}
+
+// signingKey is one entry of the key set. Keys loaded from a public key file
+// only verify; they belong to other services that mint tokens.
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer // nil for verify-only keys
+	public  crypto.PublicKey
+}
+
+type keySet struct {
+	keys   map[string]*signingKey
+	active *signingKey
+}
+
+// KeyProvider serves the signing and verification keys. The key set is
+// swapped atomically on reload so rotation needs no restart.
+//
+// Each <kid>.pem file in dir holds either a private key (RSA, P-256 or
+// Ed25519) or a PUBLIC KEY. Tokens are signed with the key named in the
+// "active" file, or with the greatest private kid when that file is missing.
+type KeyProvider struct {
+	dir string
+	set atomic.Pointer[keySet]
+}
+
+var keys *KeyProvider
+
+// NewKeyProvider loads keys from dir. An empty dir generates an ephemeral
+// Ed25519 key, so tokens do not survive a restart.
+func NewKeyProvider(dir string) (*KeyProvider, error) {
+	p := &KeyProvider{dir: dir}
+	if dir == "" {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k := &signingKey{kid: "ephemeral-" + randomToken(6), method: jwt.SigningMethodEdDSA, private: priv, public: pub}
+		p.set.Store(&keySet{keys: map[string]*signingKey{k.kid: k}, active: k})
+		return p, nil
+	}
+
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the key directory. On error the current key set is kept.
+func (p *KeyProvider) Reload() error {
+	if p.dir == "" {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(p.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	set := &keySet{keys: make(map[string]*signingKey)}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		k, err := loadKey(kid, path)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kid, err)
+		}
+		set.keys[kid] = k
+	}
+
+	active, err := os.ReadFile(filepath.Join(p.dir, "active"))
+	switch {
+	case err == nil:
+		kid := strings.TrimSpace(string(active))
+		set.active = set.keys[kid]
+		if set.active == nil || set.active.private == nil {
+			return fmt.Errorf("active key %q has no private key", kid)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		kids := make([]string, 0, len(set.keys))
+		for kid, k := range set.keys {
+			if k.private != nil {
+				kids = append(kids, kid)
+			}
+		}
+		if len(kids) == 0 {
+			return errors.New("no private key in " + p.dir)
+		}
+		sort.Strings(kids)
+		set.active = set.keys[kids[len(kids)-1]]
+	default:
+		return err
+	}
+
+	p.set.Store(set)
+	return nil
+}
+
+// watch reloads the key set periodically and whenever reload fires
+func (p *KeyProvider) watch(reload <-chan os.Signal) {
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-reload:
+		}
+		prev := p.set.Load().active.kid
+		if err := p.Reload(); err != nil {
+			slog.Error("Key reload error", "err", err)
+			continue
+		}
+		if kid := p.set.Load().active.kid; kid != prev {
+			slog.Info("Signing key rotated", "from", prev, "to", kid)
+		}
+	}
+}
+
+func loadKey(kid, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{kid: kid}
+	if signer, ok := key.(crypto.Signer); ok {
+		k.private = signer
+		k.public = signer.Public()
+	} else {
+		k.public = key
+	}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		k.method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return k, nil
+}
+
+// Sign signs claims with the active key and names it in the "kid" header
+func (p *KeyProvider) Sign(claims jwt.Claims) (string, error) {
+	k := p.set.Load().active
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.private)
+}
+
+// Keyfunc picks the verification key by "kid" and rejects tokens whose
+// algorithm doesn't match that key
+func (p *KeyProvider) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := p.set.Load().keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if t.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("key %q does not sign with %s", kid, t.Method.Alg())
+	}
+	return k.public, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func (k *signingKey) jwk() jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	j := jwk{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = b64(pub.N.Bytes())
+		j.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdh, _ := pub.ECDH()
+		raw := ecdh.Bytes() // 0x04 || X || Y
+		j.Kty, j.Crv = "EC", "P-256"
+		j.X = b64(raw[1:33])
+		j.Y = b64(raw[33:])
+	case ed25519.PublicKey:
+		j.Kty, j.Crv = "OKP", "Ed25519"
+		j.X = b64(pub)
+	}
+	return j
+}
+
+// jwksHandler publishes every public key so other services can verify tokens
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set := keys.set.Load()
+	kids := make([]string, 0, len(set.keys))
+	for kid := range set.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	resp := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+	for _, kid := range kids {
+		resp.Keys = append(resp.Keys, set.keys[kid].jwk())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(resp)
+}
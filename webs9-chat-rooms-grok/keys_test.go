@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKey stores key in dir as <kid>.pem, as PKCS #8 for private keys and
+// PKIX for public ones
+func writeKey(t *testing.T, dir, kid string, key any) {
+	t.Helper()
+	var block *pem.Block
+	if pub, ok := key.(ed25519.PublicKey); ok {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signTest(t *testing.T, p *KeyProvider) (string, string) {
+	t.Helper()
+	s, err := p.Sign(jwt.RegisteredClaims{Subject: "1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	token, err := jwt.Parse(s, p.Keyfunc, jwt.WithValidMethods(validSigningMethods))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return s, kid
+}
+
+func TestKeyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "2024-a", rsaKey)
+	writeKey(t, dir, "2024-b", ecKey)
+	writeKey(t, dir, "2099-other", otherPub)
+
+	p, err := NewKeyProvider(dir)
+	if err != nil {
+		t.Fatalf("NewKeyProvider: %v", err)
+	}
+	// Verify-only keys are never active, however they sort
+	old, kid := signTest(t, p)
+	if kid != "2024-b" {
+		t.Errorf("signed with %q, want the greatest private kid 2024-b", kid)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "active"), []byte("2024-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, kid := signTest(t, p); kid != "2024-a" {
+		t.Errorf("signed with %q, want the active key 2024-a", kid)
+	}
+	// Tokens signed before the rotation still verify
+	if _, err := jwt.Parse(old, p.Keyfunc, jwt.WithValidMethods(validSigningMethods)); err != nil {
+		t.Errorf("token from the previous key: %v", err)
+	}
+
+	// A bad key set is rejected and the current one kept
+	os.WriteFile(filepath.Join(dir, "active"), []byte("2099-other"), 0o600)
+	if err := p.Reload(); err == nil {
+		t.Error("Reload with a verify-only active key succeeded")
+	}
+	if _, kid := signTest(t, p); kid != "2024-a" {
+		t.Errorf("signed with %q after a failed reload, want 2024-a", kid)
+	}
+}
+
+func TestLoadKeyRejects(t *testing.T) {
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	for name, key := range map[string]any{"rsa1024": small, "p384": p384} {
+		dir := t.TempDir()
+		writeKey(t, dir, name, key)
+		if _, err := loadKey(name, filepath.Join(dir, name+".pem")); err == nil {
+			t.Errorf("%s key loaded", name)
+		}
+	}
+}
+
+func TestKeyfuncChecksAlgorithm(t *testing.T) {
+	_, kid := signTest(t, keys)
+
+	// An HMAC token "signed" with the public key must not verify against it
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	token.Header["kid"] = kid
+	s, _ := token.SignedString([]byte("secret"))
+	if _, err := parseAccessToken(s); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{Subject: "1"})
+	token.Header["kid"] = "unknown"
+	if _, err := keys.Keyfunc(token); err == nil {
+		t.Error("token with an unknown kid accepted")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	code, body := api(t, "GET", "/.well-known/jwks.json", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("jwks: %d", code)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		t.Fatal(err)
+	}
+
+	_, kid := signTest(t, keys)
+	if len(set.Keys) != 1 || set.Keys[0].Kid != kid {
+		t.Fatalf("jwks = %+v, want the signing key %s", set.Keys, kid)
+	}
+	if k := set.Keys[0]; k.Kty != "OKP" || k.Crv != "Ed25519" || k.Alg != "EdDSA" || k.X == "" {
+		t.Errorf("jwk = %+v", k)
+	}
+}
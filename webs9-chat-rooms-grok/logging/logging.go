@@ -0,0 +1,74 @@
+// Package logging sets up the JSON logs of the websocket servers and keeps
+// credentials out of them.
+package logging
+
+import (
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Logged in place of a secret
+const Redacted = "[REDACTED]"
+
+// Attribute and query parameter names whose values are never logged
+var secretKeys = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"password":      true,
+	"authorization": true,
+}
+
+// Setup makes a JSON logger on stderr the default for both slog and the log
+// package. level is debug, info, warn or error.
+func Setup(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level:       l,
+		ReplaceAttr: redact,
+	})))
+	return nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// RedactURL returns u with the values of secret query parameters replaced
+func RedactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && secretKeys[strings.ToLower(name)] {
+			params[i] = key + "=" + Redacted
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.String()
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+var lastConnID atomic.Uint64
+
+// NextConnID returns a connection ID unique within the process
+func NextConnID() uint64 {
+	return lastConnID.Add(1)
+}
@@ -3,19 +3,65 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	_ "github.com/mattn/go-sqlite3"
+
+	"webs9-chat-db/bus"
+	"webs9-chat-db/logging"
+	"webs9-chat-db/metrics"
+	"webs9-chat-db/store"
 )
 
 var (
-	jwtSecret = []byte("super-secret-key-change-in-production")
+	addr      = flag.String("addr", ":8080", "HTTP listen address; run several nodes sharing -bus behind a load balancer")
+	keysDir   = flag.String("keys", "", "directory of PEM signing keys (empty generates a temporary key)")
+	adminList = flag.String("admins", "", "comma-separated usernames allowed to use the /admin API")
+
+	rateUser = flag.String("rate-user", "2:10", "per-user limit on writes as rate:burst, rate per second (0:0 unlimited)")
+	rateIP   = flag.String("rate-ip", "5:20", "per-IP limit on writes as rate:burst")
+	rateRoom = flag.String("rate-room", "20:50", "per-room limit on chat messages as rate:burst")
+	rateKick = flag.Int("rate-kick", 0, "close connections with 1008 after this many rate-limited frames in a minute (0 never)")
+
+	maxMessageLen     = flag.Int("max-message-len", 2000, "longest message in characters (0 unlimited)")
+	bannedWordsFile   = flag.String("banned-words", "", "file of banned words, one per line")
+	bannedWordsAction = flag.String("banned-words-action", "mask", "what to do with banned words: mask, reject or flag")
+	urlAllowlist      = flag.String("url-allowlist", "", "comma-separated hosts links may point to (empty allows all)")
+	spamRepeats       = flag.Int("spam-repeats", 3, "reject a message sent this many times already within -spam-window (0 off)")
+	spamWindow        = flag.Duration("spam-window", 30*time.Second, "window for -spam-repeats")
+
+	storeSpec  = flag.String("store", "sqlite", "where room messages are kept: sqlite, memory, memory:N (last N per room) or file:DIR")
+	writeBatch = flag.Int("write-batch", 100, "most messages stored in one transaction")
+	writeDelay = flag.Duration("write-delay", 10*time.Millisecond, "longest a message waits for its write batch to fill")
+	writeQueue = flag.Int("write-queue", 1000, "messages waiting to be stored before senders are told to retry")
+
+	requireSearch = flag.Bool("require-search", false, "refuse to start without full-text search, which the sqlite store only has when built with -tags sqlite_fts5")
+
+	retentionAge       = flag.Duration("retention-age", 0, "default for rooms: delete messages older than this (0 keeps them)")
+	retentionCount     = flag.Int("retention-count", 0, "default for rooms: keep only the newest N messages (0 keeps all)")
+	purgeInterval      = flag.Duration("purge-interval", 10*time.Minute, "how often expired messages are deleted (0 never)")
+	checkpointInterval = flag.Duration("checkpoint-interval", 5*time.Minute, "how often the SQLite WAL is checkpointed (0 never)")
+	vacuumInterval     = flag.Duration("vacuum-interval", 24*time.Hour, "how often the database is vacuumed (0 never)")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "longest a shutdown waits for queued messages and clients")
+	reconnectAfter  = flag.Duration("reconnect-after", 2*time.Second, "least time clients are told to wait before reconnecting after a shutdown")
+
+	logLevel = flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+
+	busSpec    = flag.String("bus", "local", "how nodes share room traffic: local (single node) or a redis:// URL; nodes sharing a bus must share the sqlite store")
+	nodeIDFlag = flag.String("node-id", "", "ID of this node on the bus (empty picks a random one)")
 
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
@@ -25,40 +71,289 @@ var (
 )
 
 type Message struct {
-	Type      string `json:"type"` // "message", "join", "auth_success", "error"
+	Type      string `json:"type"` // "message", "join", "auth_success", "history", "error"
+	ID        int64  `json:"id,omitempty"`
 	Username  string `json:"username,omitempty"`
 	Room      string `json:"room,omitempty"`
 	Content   string `json:"content,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Seq       int64  `json:"seq,omitempty"` // per-room sequence number
 	Timestamp string `json:"timestamp"`
+	EditedAt  string `json:"edited_at,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"` // tombstone, content removed
+
+	// Threads: replies point at the thread's root message, which carries
+	// the number of replies in history
+	ParentID   int64 `json:"parent_id,omitempty"`
+	ReplyCount int   `json:"reply_count,omitempty"`
+
+	// Reactions: the emoji of a react/unreact request and the counts per
+	// emoji in history and reaction_updated events
+	Emoji     string          `json:"emoji,omitempty"`
+	Reactions []reactionCount `json:"reactions,omitempty"`
+
+	// Presence roster answering "who"
+	Users []string `json:"users,omitempty"`
+
+	// Direct messages: the recipient's username and the conversation
+	ConversationID int64  `json:"conversation_id,omitempty"`
+	To             string `json:"to,omitempty"`
+
+	// History paging: requests carry Before/Limit, responses carry Messages
+	// and the Before cursor of the next page (0 when there is none)
+	Before   int64     `json:"before,omitempty"`
+	Limit    int       `json:"limit,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+
+	// Search results: the matching text with hits wrapped in <mark>
+	Snippet string `json:"snippet,omitempty"`
+
+	// Resume: the last seq the client has seen
+	Since int64 `json:"since,omitempty"`
+
+	// Sender-chosen ID echoed in the ack/nack; retries with the same ID are
+	// stored once per user. Code is the machine-readable nack reason.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Code        string `json:"code,omitempty"`
+
+	// Rate limiting: how long to wait before sending again
+	RetryAfter int64 `json:"retry_after_ms,omitempty"`
+
+	// Moderation: length of a mute or ban in seconds, 0 for the default
+	Duration int64 `json:"duration,omitempty"`
+
+	// Set by readPump for the hub: sending client and its user ID, and the
+	// recipient's user ID for direct messages
+	from     *Client
+	userID   string
+	toUserID string
+}
+
+// LogValue describes a frame for the logs, leaving out the token of auth
+// frames
+func (m Message) LogValue() slog.Value {
+	content := m.Content
+	if m.Type == "auth" {
+		content = logging.Redacted
+	}
+	attrs := []slog.Attr{slog.String("type", m.Type), slog.String("content", content)}
+	if m.Room != "" {
+		attrs = append(attrs, slog.String("room", m.Room))
+	}
+	if m.ClientMsgID != "" {
+		attrs = append(attrs, slog.String("client_msg_id", m.ClientMsgID))
+	}
+	return slog.GroupValue(attrs...)
 }
 
 type Client struct {
-	conn   *websocket.Conn
-	send   chan []byte
-	userID string // empty if not authenticated
-	room   string
+	conn *websocket.Conn
+	send chan []byte
+	sess atomic.Pointer[session] // nil if not authenticated
+	ip   string
+
+	// Logger tagged with the connection's ID and IP
+	log *slog.Logger
+
+	// Room the connection was opened with, used by frames without a room
+	room string
+	// Rooms subscribed to, written by the hub goroutine under hub.mu
+	subs map[string]*subscription
+
+	// Rate-limited frames since strikesSince, owned by readPump
+	strikes      int
+	strikesSince time.Time
+
+	// Close frame written by writePump once the hub closes send, if set
+	closeFrame []byte
+
+	// Guards send against readPump replying after the hub closed it
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *Client) authenticated() bool {
+	return c.sess.Load() != nil
+}
+
+// reply queues a message for this client only. It is safe to call from
+// readPump at any time; messages to a closed or full client are dropped.
+func (c *Client) reply(m Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- marshal(m):
+	default:
+	}
+}
+
+// ack confirms to the sender that m was stored
+func (c *Client) ack(m Message) {
+	c.reply(Message{Type: "ack", ClientMsgID: m.ClientMsgID, ID: m.ID, Seq: m.Seq, Room: m.Room, Timestamp: m.Timestamp})
+}
+
+// nack tells the sender that m was not accepted and why
+func (c *Client) nack(m Message, code, reason string) {
+	c.reply(Message{Type: "nack", ClientMsgID: m.ClientMsgID, Code: code, Content: reason, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// sendTo queues a frame for a client from the hub goroutine. It never
+// blocks: a client whose buffer is full gets no more frames and is closed by
+// dropSlow at the end of the step. Callers may hold h.mu.
+func (h *Hub) sendTo(c *Client, m Message) {
+	h.sendData(c, marshal(m))
+}
+
+// sendData is sendTo for a frame marshaled once for many clients
+func (h *Hub) sendData(c *Client, data []byte) {
+	if h.slow[c] {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		metrics.SendDrops.Inc()
+		c.log.Warn("Send buffer full, dropping client")
+		h.slow[c] = true
+	}
+}
+
+// dropSlow closes the clients sendTo found with a full buffer
+func (h *Hub) dropSlow() {
+	if len(h.slow) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.slow {
+		h.removeClient(c, nil)
+		delete(h.slow, c)
+	}
+}
+
+// close closes the send channel, making writePump send closeFrame and exit.
+// Only the hub calls it.
+func (c *Client) close(closeFrame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeFrame = closeFrame
+	c.closed = true
+	close(c.send)
 }
 
 type Hub struct {
-	rooms      map[string]map[*Client]bool
-	mu         sync.RWMutex
-	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
+	rooms         map[string]map[*Client]*subscription
+	clients       map[*Client]bool
+	users         map[string]map[*Client]bool // authenticated clients by user ID
+	mu            sync.RWMutex
+	broadcast     chan Message
+	notify        chan Message // room events that are not stored as messages
+	direct        chan Message // direct messages, already stored
+	register      chan *Client
+	unregister    chan *Client
+	roomSub       chan subscribeRequest
+	roomUnsub     chan subscribeRequest
+	disconnect    chan disconnectRequest
+	kick          chan kickRequest
+	authenticated chan *Client
+	memberChanged chan memberChange
+	resume        chan resumeRequest
+	threadSub     chan threadRequest
+	recheck       chan struct{}
+
+	// Last seq delivered per room, owned by the hub goroutine. Later ones may
+	// be waiting for the writer or the bus.
+	delivered map[string]int64
+
+	// Carries room traffic to and from the other nodes, set up in main.
+	// remote is the hub's subscription.
+	bus    bus.Bus
+	remote <-chan bus.Envelope
+
+	// Persists chat messages, set up in main. inflight holds the user ID and
+	// client_msg_id of queued messages, so retries aren't queued twice.
+	writer   *messageWriter
+	inflight map[string]bool
+	shutdown chan chan struct{}
+	stopped  chan struct{} // closed when run returns
+
+	// Users online per room, by user ID
+	presence   map[string]map[string]*presenceEntry
+	presenceMu sync.RWMutex
+
+	// Events raised during the current step, delivered to this node's
+	// clients by flushEvents
+	pending []Message
+
+	// Clients whose send buffer filled up during the current step, closed
+	// by dropSlow
+	slow map[*Client]bool
+
+	// Typing indicators, separate from broadcast; state per room and user ID
+	typing      chan typingEvent
+	typingUsers map[string]map[string]*typingState
+}
+
+// disconnectRequest asks the hub to close a client with a close frame
+type disconnectRequest struct {
+	client     *Client
+	closeFrame []byte
+}
+
+// memberChange tells the hub that a user's role in a room was changed
+type memberChange struct {
+	room   string
+	userID string
 }
 
 var hub = Hub{
-	rooms:      make(map[string]map[*Client]bool),
-	broadcast:  make(chan Message, 100),
-	register:   make(chan *Client),
-	unregister: make(chan *Client),
+	rooms:         make(map[string]map[*Client]*subscription),
+	clients:       make(map[*Client]bool),
+	users:         make(map[string]map[*Client]bool),
+	broadcast:     make(chan Message, 100),
+	notify:        make(chan Message, 100),
+	direct:        make(chan Message, 100),
+	register:      make(chan *Client),
+	unregister:    make(chan *Client),
+	roomSub:       make(chan subscribeRequest),
+	roomUnsub:     make(chan subscribeRequest),
+	disconnect:    make(chan disconnectRequest),
+	kick:          make(chan kickRequest),
+	authenticated: make(chan *Client),
+	memberChanged: make(chan memberChange),
+	resume:        make(chan resumeRequest),
+	threadSub:     make(chan threadRequest),
+	recheck:       make(chan struct{}, 1),
+	delivered:     make(map[string]int64),
+	inflight:      make(map[string]bool),
+	shutdown:      make(chan chan struct{}),
+	stopped:       make(chan struct{}),
+	presence:      make(map[string]map[string]*presenceEntry),
+	typing:        make(chan typingEvent, 256),
+	typingUsers:   make(map[string]map[string]*typingState),
+	slow:          make(map[*Client]bool),
 }
 
+const (
+	// How often the hub looks for sockets whose token expired or was revoked
+	sessionCheckInterval = 10 * time.Second
+
+	maxClientMsgIDLen = 64
+)
+
 func initDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./db.sqlite")
+	db, err = sql.Open("sqlite3", "./db.sqlite?_busy_timeout=5000&_journal_mode=WAL")
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Opening DB", "err", err)
 	}
 
 	_, err = db.Exec(`
@@ -67,106 +362,506 @@ func initDB() {
 			room TEXT,
 			username TEXT,
 			content TEXT,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			seq INTEGER,
+			user_id INTEGER,
+			client_msg_id TEXT,
+			edited_at DATETIME,
+			deleted_at DATETIME,
+			parent_id INTEGER REFERENCES messages(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS message_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL REFERENCES messages(id),
+			content TEXT NOT NULL,
+			edited_by INTEGER NOT NULL REFERENCES users(id),
+			edited_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS message_edits_message ON message_edits (message_id);
+
+		CREATE TABLE IF NOT EXISTS reactions (
+			message_id INTEGER NOT NULL REFERENCES messages(id),
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			emoji TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id, emoji)
+		);
+
+		CREATE TABLE IF NOT EXISTS dm_conversations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_a INTEGER NOT NULL REFERENCES users(id),
+			user_b INTEGER NOT NULL REFERENCES users(id),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_a, user_b)
+		);
+
+		CREATE TABLE IF NOT EXISTS dm_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id INTEGER NOT NULL REFERENCES dm_conversations(id),
+			sender_id INTEGER NOT NULL REFERENCES users(id),
+			content TEXT NOT NULL,
+			client_msg_id TEXT,
 			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
+		CREATE INDEX IF NOT EXISTS dm_messages_conversation ON dm_messages (conversation_id, id);
+		CREATE UNIQUE INDEX IF NOT EXISTS dm_messages_client_msg_id ON dm_messages (sender_id, client_msg_id)
+			WHERE client_msg_id IS NOT NULL;
+
+		-- Last message each participant has read, for unread counts
+		CREATE TABLE IF NOT EXISTS dm_reads (
+			conversation_id INTEGER NOT NULL REFERENCES dm_conversations(id),
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			last_read_id INTEGER NOT NULL,
+			PRIMARY KEY (conversation_id, user_id)
+		);
+
+		-- Mutes and bans of a user and/or IP address in a room, '' for server-wide
+		CREATE TABLE IF NOT EXISTS sanctions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			room TEXT NOT NULL,
+			user_id INTEGER REFERENCES users(id),
+			ip TEXT,
+			reason TEXT,
+			created_by INTEGER NOT NULL REFERENCES users(id),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at INTEGER,
+			lifted_at DATETIME,
+			lifted_by INTEGER REFERENCES users(id)
+		);
+		CREATE INDEX IF NOT EXISTS sanctions_user ON sanctions (user_id, room) WHERE lifted_at IS NULL;
+		CREATE INDEX IF NOT EXISTS sanctions_ip ON sanctions (ip, room) WHERE lifted_at IS NULL;
+
+		-- Retention policy per room, '' for the server default
+		CREATE TABLE IF NOT EXISTS room_retention (
+			room TEXT PRIMARY KEY,
+			max_age INTEGER NOT NULL DEFAULT 0,
+			max_count INTEGER NOT NULL DEFAULT 0,
+			keep_forever INTEGER NOT NULL DEFAULT 0,
+			updated_by INTEGER REFERENCES users(id),
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- Audit trail of moderation actions
+		CREATE TABLE IF NOT EXISTS moderation_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			room TEXT NOT NULL,
+			action TEXT NOT NULL,
+			actor_id INTEGER NOT NULL REFERENCES users(id),
+			target_id INTEGER REFERENCES users(id),
+			target_ip TEXT,
+			reason TEXT,
+			expires_at INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS moderation_log_room ON moderation_log (room, id);
+
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			expires_at INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti TEXT PRIMARY KEY,
+			expires_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS user_logouts (
+			user_id TEXT PRIMARY KEY,
+			at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS rooms (
+			name TEXT PRIMARY KEY,
+			owner_id INTEGER NOT NULL REFERENCES users(id),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS room_members (
+			room TEXT NOT NULL REFERENCES rooms(name),
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			role TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room, user_id)
+		);
 	`)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Creating DB tables", "err", err)
+	}
+
+	if err := migrateDB(); err != nil {
+		logging.Fatal("Migrating DB", "err", err)
 	}
+	initSearch()
 }
 
-func saveMessage(room, username, content string) {
-	_, err := db.Exec("INSERT INTO messages (room, username, content) VALUES (?, ?, ?)", room, username, content)
+// migrateDB brings databases created by older versions up to date
+func migrateDB() error {
+	added, err := addColumn("messages", "seq", "INTEGER")
 	if err != nil {
-		log.Println("DB save error:", err)
+		return err
+	}
+	if added {
+		// Number existing messages per room in insertion order
+		_, err = db.Exec(`
+			UPDATE messages SET seq = (
+				SELECT COUNT(*) FROM messages m WHERE m.room = messages.room AND m.id <= messages.id
+			) WHERE seq IS NULL`)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := addColumn("messages", "user_id", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := addColumn("messages", "client_msg_id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := addColumn("messages", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	if _, err := addColumn("messages", "deleted_at", "DATETIME"); err != nil {
+		return err
 	}
+	if _, err := addColumn("messages", "parent_id", "INTEGER REFERENCES messages(id)"); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS messages_room_seq ON messages (room, seq);
+		CREATE UNIQUE INDEX IF NOT EXISTS messages_client_msg_id ON messages (user_id, client_msg_id)
+			WHERE client_msg_id IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS messages_parent ON messages (parent_id) WHERE parent_id IS NOT NULL;
+	`)
+	return err
 }
 
-func getRecentMessages(room string, limit int) []Message {
-	rows, err := db.Query("SELECT username, content, timestamp FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?", room, limit)
+// addColumn adds a column unless the table already has it and reports
+// whether it did
+func addColumn(table, column, decl string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
 	if err != nil {
-		return nil
+		return false, err
 	}
 	defer rows.Close()
-
-	var msgs []Message
 	for rows.Next() {
-		var username, content, ts string
-		rows.Scan(&username, &content, &ts)
-		msgs = append(msgs, Message{
-			Type:      "message",
-			Username:  username,
-			Content:   content,
-			Timestamp: ts,
-			Room:      room,
-		})
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
 	}
-	// Reverse to chronological order
-	for i := len(msgs)/2 - 1; i >= 0; i-- {
-		opp := len(msgs) - 1 - i
-		msgs[i], msgs[opp] = msgs[opp], msgs[i]
+	if err := rows.Err(); err != nil {
+		return false, err
 	}
-	return msgs
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err == nil, err
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
 }
 
 func (h *Hub) run() {
+	sessionCheck := time.NewTicker(sessionCheckInterval)
+	defer sessionCheck.Stop()
+	typingCheck := time.NewTicker(time.Second)
+	defer typingCheck.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			if h.rooms[client.room] == nil {
-				h.rooms[client.room] = make(map[*Client]bool)
-			}
-			h.rooms[client.room][client] = true
+			h.clients[client] = true
 			h.mu.Unlock()
+			client.log.Debug("Client registered")
+
+		case req := <-h.roomSub:
+			h.subscribe(req)
 
-			welcome := Message{Type: "join", Content: "Welcome to room: " + client.room, Timestamp: time.Now().Format(time.RFC3339)}
-			client.send <- marshal(welcome)
+		case req := <-h.roomUnsub:
+			h.unsubscribe(req)
 
-			// Send history (public always gets it, private only if authenticated)
-			if client.room == "public" || client.userID != "" {
-				for _, m := range getRecentMessages(client.room, 20) {
-					client.send <- marshal(m)
+		case client := <-h.authenticated:
+			h.mu.Lock()
+			if h.clients[client] {
+				userID := client.sess.Load().userID
+				if h.users[userID] == nil {
+					h.users[userID] = make(map[*Client]bool)
 				}
+				h.users[userID][client] = true
 			}
+			subs := make([]*subscription, 0, len(client.subs))
+			for _, sub := range client.subs {
+				subs = append(subs, sub)
+			}
+			h.mu.Unlock()
+			for _, sub := range subs {
+				h.admit(sub)
+			}
+
+		case change := <-h.memberChanged:
+			h.applyMemberChange(change)
+			h.share(busEvent{Kind: busMember, Message: Message{Room: change.room}, UserID: change.userID})
+
+		case req := <-h.resume:
+			h.handleResume(req)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if roomClients, ok := h.rooms[client.room]; ok {
-				if _, ok := roomClients[client]; ok {
-					delete(roomClients, client)
-					close(client.send)
-					if len(roomClients) == 0 {
-						delete(h.rooms, client.room)
-					}
-				}
-			}
+			h.removeClient(client, nil)
+			h.mu.Unlock()
+
+		case req := <-h.disconnect:
+			h.mu.Lock()
+			h.removeClient(req.client, req.closeFrame)
 			h.mu.Unlock()
 
+		case req := <-h.kick:
+			h.kickAll(req)
+
 		case message := <-h.broadcast:
-			data := marshal(message)
-			saveMessage(message.Room, message.Username, message.Content)
+			h.publish(message)
 
-			h.mu.RLock()
-			clients := h.rooms[message.Room]
-			h.mu.RUnlock()
+		case results := <-h.writer.results:
+			h.persisted(results)
 
-			for client := range clients {
-				if message.Room != "public" && client.userID == "" {
-					continue // block unauth in private rooms
-				}
+		case done := <-h.shutdown:
+			h.drainAndClose()
+			close(h.stopped)
+			close(done)
+			return
 
-				select {
-				case client.send <- data:
-				default:
-					// Client is dead/slow
-					h.mu.Lock()
-					delete(h.rooms[client.room], client)
-					close(client.send)
-					h.mu.Unlock()
-				}
+		case event := <-h.notify:
+			h.fanOut(event)
+
+		case m := <-h.direct:
+			h.deliverDM(m)
+
+		case e, ok := <-h.remote:
+			if !ok {
+				h.remote = nil
+				break
 			}
+			h.fromBus(e)
+
+		case req := <-h.threadSub:
+			h.subscribeThread(req)
+
+		case ev := <-h.typing:
+			h.handleTyping(ev)
+
+		case <-typingCheck.C:
+			h.expireTyping()
+
+		case <-sessionCheck.C:
+			h.closeExpiredSessions()
+
+		case <-h.recheck:
+			h.closeExpiredSessions()
+		}
+
+		h.flushEvents()
+		h.dropSlow()
+	}
+}
+
+// publish queues a chat message for the writer; persisted acks and
+// delivers it once stored. A retry of a message the user
+// already sent is only acked again: the store finds it by client_msg_id
+// while writing, off the hub goroutine.
+func (h *Hub) publish(message Message) {
+	key := ""
+	if message.userID != "" && message.ClientMsgID != "" {
+		key = message.userID + "\x00" + message.ClientMsgID
+		if h.inflight[key] {
+			// Acked when the queued copy is stored
+			return
+		}
+	}
+
+	// Load it while none of the room's messages is being written
+	h.deliveredSeq(message.Room)
+	if !h.writer.enqueue(message) {
+		message.from.reply(Message{
+			Type:        "nack",
+			ClientMsgID: message.ClientMsgID,
+			Code:        "overloaded",
+			Content:     "Server busy, try again",
+			RetryAfter:  writeRetryAfter.Milliseconds(),
+			Timestamp:   time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+	if key != "" {
+		h.inflight[key] = true
+	}
+
+	if message.userID != "" {
+		h.stopTyping(message.Room, message.userID)
+	}
+}
+
+// persisted handles a batch stored by the writer: stored messages are acked
+// and delivered in order, failed ones are nacked.
+func (h *Hub) persisted(results []writeResult) {
+	for _, r := range results {
+		message := r.message
+		if message.userID != "" && message.ClientMsgID != "" {
+			delete(h.inflight, message.userID+"\x00"+message.ClientMsgID)
 		}
+		if r.err != nil {
+			message.from.nack(message, "persist_failed", "Could not save message")
+			continue
+		}
+		if r.duplicate {
+			// Delivered when it was first stored
+			message.from.ack(message)
+			continue
+		}
+		// Another node's later message may have been delivered already
+		h.delivered[message.Room] = max(h.delivered[message.Room], message.Seq)
+		message.from.ack(message)
+		h.fanOut(message)
+	}
+}
+
+// fanOut delivers message to every live client in its room, on this node
+// and, through the bus, on the others
+func (h *Hub) fanOut(message Message) {
+	h.deliverRoom(message)
+	h.share(busEvent{Kind: busRoom, Message: message})
+}
+
+// deliverRoom delivers message to the live clients of its room on this node
+func (h *Hub) deliverRoom(message Message) {
+	data := marshal(message)
+
+	h.mu.RLock()
+	clients := h.rooms[message.Room]
+	h.mu.RUnlock()
+
+	for client, sub := range clients {
+		if !sub.live {
+			continue
+		}
+		if sub.thread != 0 && message.ID != 0 && message.ID != sub.thread && message.ParentID != sub.thread {
+			continue
+		}
+
+		h.sendData(client, data)
+	}
+}
+
+// admit looks up the client's role in a subscribed room and starts live
+// delivery if it may read it
+func (h *Hub) admit(sub *subscription) {
+	if h.subscription(sub.client, sub.room) != sub {
+		return
+	}
+
+	sub.role = clientRole(sub.client, sub.room)
+	if sub.role.canRead() && !sub.live {
+		h.goLive(sub)
+	}
+	h.markPresent(sub)
+}
+
+// applyMemberChange refreshes the role of the user's subscriptions to the
+// room and drops those that lost read access
+func (h *Hub) applyMemberChange(change memberChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client, sub := range h.rooms[change.room] {
+		s := client.sess.Load()
+		if s == nil || s.userID != change.userID {
+			continue
+		}
+		sub.role = clientRole(client, change.room)
+		if !sub.role.canRead() {
+			h.revokeSubscription(sub, "forbidden", "removed from room")
+			continue
+		}
+		if !sub.live {
+			h.goLive(sub)
+			h.markPresent(sub)
+		}
+		select {
+		case client.send <- marshal(Message{Type: "role_changed", Room: change.room, Role: sub.role.String(), Timestamp: time.Now().Format(time.RFC3339)}):
+		default:
+		}
+	}
+}
+
+// removeClient drops client from all of its rooms and closes its send
+// channel. A nil closeFrame sends an empty close message. The caller must
+// hold h.mu.
+func (h *Hub) removeClient(client *Client, closeFrame []byte) {
+	if !h.clients[client] {
+		return
+	}
+	for _, sub := range client.subs {
+		h.dropSubscription(sub)
+	}
+	delete(h.clients, client)
+	if s := client.sess.Load(); s != nil {
+		delete(h.users[s.userID], client)
+		if len(h.users[s.userID]) == 0 {
+			delete(h.users, s.userID)
+		}
+	}
+	client.close(closeFrame)
+}
+
+// closeExpiredSessions disconnects every client whose access token expired or
+// was revoked, so it has to refresh and authenticate again
+func (h *Hub) closeExpiredSessions() {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		s := client.sess.Load()
+		if s == nil {
+			continue
+		}
+		reason := ""
+		switch {
+		case isRevoked(s):
+			reason = "token revoked"
+		case s.expired(now):
+			reason = "token expired"
+		default:
+			continue
+		}
+		client.log.Info("Closing session", "reason", reason)
+		h.removeClient(client, websocket.FormatCloseMessage(closeAuthExpired, reason))
+	}
+}
+
+// recheckSessions asks the hub to look for revoked tokens now rather than on
+// its next tick
+func (h *Hub) recheckSessions() {
+	select {
+	case h.recheck <- struct{}{}:
+	default:
 	}
 }
 
@@ -176,9 +871,35 @@ func marshal(v any) []byte {
 }
 
 func handleConnections(w http.ResponseWriter, r *http.Request) {
+	if !admit() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	pumping := false
+	defer func() {
+		if !pumping {
+			writePumps.Done()
+		}
+	}()
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	logger := slog.With("conn", logging.NextConnID(), "ip", ip)
+	if banned, err := sanctioned(sanctionBan, serverWide, "", ip); err != nil {
+		logger.Error("DB sanction error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	} else if banned {
+		http.Error(w, "Banned", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		metrics.UpgradeErrors.Inc()
+		logger.Warn("Upgrade error", "err", err)
 		return
 	}
 
@@ -191,18 +912,35 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 
 	room := r.URL.Query().Get("room")
 	if room == "" {
-		room = "public"
+		room = publicRoom
+	}
+
+	since := int64(-1)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			since = n
+		}
 	}
 
 	client := &Client{
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		room:   room,
-		userID: "",
+		conn: conn,
+		send: make(chan []byte, 256),
+		ip:   ip,
+		log:  logger,
+		room: room,
+		subs: make(map[string]*subscription),
 	}
+	logger.Info("Connection opened", "url", logging.RedactURL(r.URL))
 
-	hub.register <- client
+	select {
+	case hub.register <- client:
+	case <-hub.stopped:
+		conn.Close()
+		return
+	}
+	pumping = true
 	go client.writePump()
+	hub.roomSub <- subscribeRequest{client: client, room: room, since: since}
 	client.readPump()
 }
 
@@ -210,64 +948,275 @@ func (c *Client) readPump() {
 	defer func() {
 		hub.unregister <- c
 		c.conn.Close()
+		c.log.Info("Connection closed")
 	}()
 
 	for {
 		var msg Message
 		err := c.conn.ReadJSON(&msg)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Unexpected close error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, closeAuthExpired, closeRoomForbidden) {
+				c.log.Warn("Unexpected close error", "err", err)
+			} else {
+				c.log.Debug("Read ended", "err", err)
 			}
 			break
 		}
+		metrics.MessagesIn.Inc()
+		c.log.Debug("Frame received", "frame", msg)
+
+		// Authentication. A client may send a fresh token before the current
+		// one expires to keep its session; it must belong to the same user.
+		if msg.Type == "auth" {
+			s, err := parseAccessToken(msg.Content)
+			if err != nil {
+				metrics.AuthFailures.Inc()
+				c.log.Warn("Invalid token", "err", err)
+				c.reply(Message{Type: "error", Content: "Invalid token"})
+				continue
+			}
 
-		// Authentication
-		if msg.Type == "auth" && c.userID == "" {
-			token, err := jwt.Parse(msg.Content, func(t *jwt.Token) (interface{}, error) {
-				return jwtSecret, nil
+			prev := c.sess.Load()
+			if prev != nil && prev.userID != s.userID {
+				c.log.Warn("Token belongs to another user", "user_id", s.userID)
+				c.reply(Message{Type: "error", Content: "Token belongs to another user"})
+				continue
+			}
+			if banned, err := sanctioned(sanctionBan, serverWide, s.userID, ""); err != nil || banned {
+				if err != nil {
+					c.log.Error("DB sanction error", "err", err)
+				}
+				hub.disconnect <- disconnectRequest{client: c, closeFrame: websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned")}
+				c.drain()
+				continue
+			}
+			c.sess.Store(s)
+			if prev == nil {
+				c.log.Info("Authenticated", "user", s.username, "user_id", s.userID)
+			}
+
+			c.reply(Message{
+				Type: "auth_success", Username: s.username, Content: "Authenticated!", Timestamp: time.Now().Format(time.RFC3339),
 			})
 
-			if err != nil || !token.Valid {
-				c.send <- marshal(Message{Type: "error", Content: "Invalid token"})
+			// Let the hub check room access and send history after the first auth
+			if prev == nil {
+				hub.authenticated <- c
+			}
+			continue
+		}
+
+		room := c.roomFor(msg)
+
+		// Subscriptions are checked per room by the hub. Since 0 or absent
+		// sends recent history; use resume afterwards to replay from the start.
+		switch msg.Type {
+		case "subscribe":
+			if msg.Room == "" {
+				c.reply(Message{Type: "error", Content: "Missing room"})
 				continue
 			}
+			if c.rateLimited(msg) {
+				continue
+			}
+			since := int64(-1)
+			if msg.Since > 0 {
+				since = msg.Since
+			}
+			hub.roomSub <- subscribeRequest{client: c, room: msg.Room, since: since}
+			continue
 
-			claims := token.Claims.(jwt.MapClaims)
-			username := claims["username"].(string)
-			c.userID = username
+		case "unsubscribe":
+			if msg.Room == "" {
+				c.reply(Message{Type: "error", Content: "Missing room"})
+				continue
+			}
+			if c.rateLimited(msg) {
+				continue
+			}
+			hub.roomUnsub <- subscribeRequest{client: c, room: msg.Room}
+			continue
+		}
 
-			c.send <- marshal(Message{
-				Type: "auth_success", Username: username, Content: "Authenticated!", Timestamp: time.Now().Format(time.RFC3339),
-			})
+		// Typing indicators are never persisted and skip broadcast
+		if msg.Type == "typing" || msg.Type == "typing_stopped" {
+			c.typing(room, msg.Type == "typing_stopped")
+			continue
+		}
 
-			// Send history after auth
-			for _, m := range getRecentMessages(c.room, 20) {
-				c.send <- marshal(m)
+		// Resume may come before auth; the replay waits until the room is readable
+		if msg.Type == "resume" {
+			if c.rateLimited(msg) {
+				continue
 			}
+			hub.resume <- resumeRequest{client: c, room: room, since: msg.Since}
 			continue
 		}
 
+		s := c.sess.Load()
+
 		// Block unauthenticated sends in private rooms
-		if c.room != "public" && c.userID == "" {
-			c.send <- marshal(Message{Type: "error", Content: "Auth required"})
+		if room != publicRoom && s == nil {
+			if msg.Type == "message" {
+				c.nack(msg, "auth_required", "Auth required")
+				continue
+			}
+			c.reply(Message{Type: "error", Content: "Auth required"})
+			continue
+		}
+
+		if c.rateLimited(msg) {
+			continue
+		}
+
+		switch msg.Type {
+		case "invite":
+			if err := setMember(room, s, msg.Username, msg.Role); err != nil {
+				c.reply(Message{Type: "error", Content: memberErrorText(err)})
+				continue
+			}
+			c.reply(Message{Type: "invite_success", Username: msg.Username, Room: room, Role: msg.Role, Timestamp: time.Now().Format(time.RFC3339)})
+			continue
+
+		case "history":
+			c.sendHistoryPage(room, msg.Before, msg.Limit)
+			continue
+
+		case "edit":
+			c.editMessage(msg.ID, msg.Content)
+			continue
+
+		case "delete":
+			c.deleteMessage(msg.ID)
+			continue
+
+		case "react", "unreact":
+			c.react(msg.ID, msg.Emoji, msg.Type == "react")
+			continue
+
+		case "subscribe_thread":
+			hub.threadSub <- threadRequest{client: c, room: room, root: msg.ID}
+			continue
+
+		case "unsubscribe_thread":
+			hub.threadSub <- threadRequest{client: c, room: room}
+			continue
+
+		case "who":
+			c.sendRoster(room)
+			continue
+
+		case "dm":
+			c.sendDM(msg)
+			continue
+
+		case "dm_read":
+			c.readDMs(msg.ConversationID, msg.ID)
+			continue
+
+		case "mute", "unmute", "kick", "ban", "unban":
+			c.moderate(msg, room)
+			continue
+
+		case "search":
+			c.sendSearchResults(msg.Content, msg.Room, msg.Limit)
+			continue
+
+		case "remove":
+			if err := removeMember(room, s, msg.Username); err != nil {
+				c.reply(Message{Type: "error", Content: memberErrorText(err)})
+				continue
+			}
+			c.reply(Message{Type: "remove_success", Username: msg.Username, Room: room, Timestamp: time.Now().Format(time.RFC3339)})
+			continue
+		}
+
+		if msg.Type != "message" {
 			continue
 		}
 
-		if msg.Type == "message" && msg.Content != "" {
-			broadcastMsg := Message{
-				Type:      "message",
-				Username:  c.userID,
-				Content:   msg.Content,
-				Room:      c.room,
-				Timestamp: time.Now().Format(time.RFC3339),
+		if !hub.subscribed(c, room) {
+			c.nack(msg, "not_subscribed", "Not subscribed to this room")
+			continue
+		}
+		if s != nil {
+			if r := clientRole(c, room); !r.canWrite() {
+				c.nack(msg, "forbidden", "Not allowed to post in this room")
+				continue
 			}
-			hub.broadcast <- broadcastMsg
+		}
+		if msg.Content == "" {
+			c.nack(msg, "invalid", "Empty message")
+			continue
+		}
+		if len(msg.ClientMsgID) > maxClientMsgIDLen {
+			c.nack(msg, "invalid", "client_msg_id too long")
+			continue
+		}
+		parentID, err := threadRoot(msg.ParentID, room)
+		if err != nil {
+			c.nack(msg, "invalid", threadErrorText(err))
+			continue
+		}
+
+		broadcastMsg := Message{
+			Type:        "message",
+			Content:     msg.Content,
+			Room:        room,
+			ClientMsgID: msg.ClientMsgID,
+			ParentID:    parentID,
+			Timestamp:   time.Now().Format(time.RFC3339),
+			from:        c,
+		}
+		if s != nil {
+			broadcastMsg.Username = s.username
+			broadcastMsg.userID = s.userID
+		}
+		if d := runFilters(&broadcastMsg); d.Action == FilterReject {
+			c.nack(msg, d.Code, d.Reason)
+			continue
+		}
+		if c.roomRateLimited(msg, room) {
+			continue
+		}
+		hub.broadcast <- broadcastMsg
+	}
+}
+
+// setupFilters builds the message filter chain from the flags
+func setupFilters() {
+	if *maxMessageLen > 0 {
+		filters = append(filters, maxLengthFilter{max: *maxMessageLen})
+	}
+	if *bannedWordsFile != "" {
+		f, err := loadBannedWords(*bannedWordsFile, *bannedWordsAction)
+		if err != nil {
+			logging.Fatal("Loading banned words", "err", err)
+		}
+		filters = append(filters, f)
+	}
+	if *urlAllowlist != "" {
+		filters = append(filters, parseURLAllowlist(*urlAllowlist))
+	}
+	if *spamRepeats > 0 {
+		filters = append(filters, newSpamFilter(*spamRepeats, *spamWindow))
+	}
+}
+
+// drain discards frames until the peer answers the close frame the hub is
+// sending, or gives up after a few seconds
+func (c *Client) drain() {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.conn.SetPongHandler(nil)
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
 		}
 	}
 }
 
 func (c *Client) writePump() {
+	defer writePumps.Done()
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -275,76 +1224,155 @@ func (c *Client) writePump() {
 		select {
 		case message, ok := <-c.send:
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.log.Debug("Sending close frame")
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeFrame)
 				return
 			}
 
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
+				c.log.Debug("Write error", "err", err)
 				return
 			}
 			w.Write(message)
+			sent := 1
 
 			// Send all queued messages in one batch
 			for len(c.send) > 0 {
 				w.Write([]byte{'\n'})
 				w.Write(<-c.send)
+				sent++
 			}
 
 			if err := w.Close(); err != nil {
+				c.log.Debug("Write error", "err", err)
 				return
 			}
+			metrics.MessagesOut.Add(float64(sent))
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.log.Debug("Ping error", "err", err)
 				return
 			}
 		}
 	}
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// registerRoutes adds the server's handlers to http.DefaultServeMux
+func registerRoutes() {
+	http.HandleFunc("/ws", handleConnections)
+	http.Handle("GET /metrics", metrics.Handler())
+	http.HandleFunc("/register", registerHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/token/refresh", refreshHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	http.HandleFunc("POST /rooms", createRoomHandler)
+	http.HandleFunc("GET /search", searchHandler)
+	http.HandleFunc("GET /rooms/{room}/messages", historyHandler)
+	http.HandleFunc("GET /messages/{id}/thread", threadHandler)
+	http.HandleFunc("GET /rooms/{room}/members", listMembersHandler)
+	http.HandleFunc("GET /rooms/{room}/members/online", onlineHandler)
+	http.HandleFunc("PUT /rooms/{room}/members/{username}", setMemberHandler)
+	http.HandleFunc("DELETE /rooms/{room}/members/{username}", removeMemberHandler)
+	http.HandleFunc("GET /dms", listDMsHandler)
+	http.HandleFunc("GET /dms/{username}/messages", dmHistoryHandler)
+	http.HandleFunc("POST /dms/{id}/read", readDMsHandler)
+	http.HandleFunc("GET /admin/rate-limits", rateLimitsHandler)
+	http.HandleFunc("PUT /admin/rate-limits", rateLimitsHandler)
+	http.HandleFunc("POST /admin/bans", serverBanHandler)
+	http.HandleFunc("DELETE /admin/bans", serverBanHandler)
+	http.HandleFunc("GET /admin/audit", auditHandler)
+	http.HandleFunc("GET /admin/retention", retentionHandler)
+	http.HandleFunc("PUT /admin/retention", retentionHandler)
+	http.HandleFunc("GET /admin/retention/{room}", roomRetentionHandler)
+	http.HandleFunc("PUT /admin/retention/{room}", roomRetentionHandler)
+	http.HandleFunc("DELETE /admin/retention/{room}", roomRetentionHandler)
+	http.HandleFunc("GET /rooms/{room}/audit", auditHandler)
+}
 
-	var creds struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+func main() {
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		logging.Fatal("Invalid -log-level", "err", err)
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+	nodeID = *nodeIDFlag
+	if nodeID == "" {
+		nodeID = randomToken(6)
 	}
+	slog.SetDefault(slog.Default().With("node", nodeID))
+	parseAdmins(*adminList)
 
-	// Dummy auth - replace with real DB check later
-	if creds.Password != "password123" {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+	for scope, spec := range map[string]string{scopeUser: *rateUser, scopeIP: *rateIP, scopeRoom: *rateRoom} {
+		l, err := parseRateLimit(spec)
+		if err != nil {
+			logging.Fatal("Parsing rate limit", "scope", scope, "err", err)
+		}
+		limiter.limits[scope] = l
 	}
+	limiter.kickAfter = *rateKick
+	go limiter.sweep()
+	setupFilters()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": creds.Username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-	})
-
-	tokenString, _ := token.SignedString(jwtSecret)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
-}
+	var err error
+	keys, err = NewKeyProvider(*keysDir)
+	if err != nil {
+		logging.Fatal("Loading keys", "err", err)
+	}
+	if *keysDir == "" {
+		slog.Warn("No -keys directory given, signing with a temporary key")
+	}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go keys.watch(reload)
 
-func main() {
+	// The memory and file stores are private to a node, so nodes on a bus
+	// would each keep, number and replay their own history
+	if *busSpec != "local" && *storeSpec != "sqlite" {
+		logging.Fatal("Nodes sharing a bus must share the sqlite store", "bus", *busSpec, "store", *storeSpec)
+	}
 	initDB()
+	if messageStore, err = openMessageStore(*storeSpec); err != nil {
+		logging.Fatal("Opening message store", "err", err)
+	}
+	hub.bus, err = bus.Open(*busSpec)
+	if err != nil {
+		logging.Fatal("Opening bus", "err", err)
+	}
+	hub.remote, err = hub.bus.Subscribe()
+	if err != nil {
+		logging.Fatal("Subscribing to bus", "err", err)
+	}
+	hub.share(busEvent{Kind: busHello})
+
+	hub.writer = newMessageWriter(messageStore, *writeBatch, *writeDelay, *writeQueue)
+	go hub.writer.run()
+	metrics.WatchBroadcastQueue(func() int { return len(hub.broadcast) })
+	loadRevocations()
+	loadMuteTimers()
 	go hub.run()
 
-	http.HandleFunc("/ws", handleConnections)
-	http.HandleFunc("/login", loginHandler)
+	if _, ok := messageStore.(store.Purger); !ok {
+		slog.Warn("Message store can't purge, retention disabled")
+	} else if p, err := defaultRetention(); err == nil {
+		slog.Info("Retention", "policy", retentionSummary(p))
+	}
+	go janitor()
 
-	fmt.Println("🚀 WebSocket Chat Server Running on :8080")
-	fmt.Println("Public room:  ws://localhost:8080/ws?room=public")
-	fmt.Println("Private room: ws://localhost:8080/ws?room=secret  (needs JWT)")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	registerRoutes()
+
+	srv := &http.Server{Addr: *addr}
+	slog.Info("WebSocket chat server running", "addr", srv.Addr,
+		"public_room", "ws://localhost:8080/ws?room=public",
+		"private_room", "ws://localhost:8080/ws?room=secret (needs JWT and membership, create with POST /rooms)")
+	go shutdownOnSignal(srv)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logging.Fatal("HTTP server error", "err", err)
+	}
+	// shutdownOnSignal exits
+	select {}
 }
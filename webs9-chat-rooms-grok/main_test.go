@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+
+	"webs9-chat-db/bus"
+)
+
+// The tests share one server: a hub, writer and local bus over a fresh
+// database in a temporary directory. Each test works with its own users and
+// rooms so they don't see each other's traffic.
+var (
+	testServer *httptest.Server
+	testIDs    atomic.Int64
+)
+
+// Username given admin rights in the tests
+const testAdmin = "admin"
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "webs9-chat-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	nodeID = "test"
+	bcryptCost = bcrypt.MinCost
+	parseAdmins(testAdmin)
+	if keys, err = NewKeyProvider(""); err != nil {
+		panic(err)
+	}
+	initDB()
+	if messageStore, err = openMessageStore("sqlite"); err != nil {
+		panic(err)
+	}
+	hub.bus = bus.NewLocal()
+	if hub.remote, err = hub.bus.Subscribe(); err != nil {
+		panic(err)
+	}
+	hub.writer = newMessageWriter(messageStore, *writeBatch, *writeDelay, *writeQueue)
+	go hub.writer.run()
+	loadRevocations()
+	go hub.run()
+
+	registerRoutes()
+	testServer = httptest.NewServer(nil)
+
+	code := m.Run()
+	testServer.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// uniqueName returns a name no other test uses
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, testIDs.Add(1))
+}
+
+type testUser struct {
+	name  string
+	token string
+}
+
+const testPassword = "secret123"
+
+// newUser registers a user and logs them in
+func newUser(t *testing.T) testUser {
+	t.Helper()
+	return registerAs(t, uniqueName("user"))
+}
+
+// adminUser logs in the admin, registering them the first time
+func adminUser(t *testing.T) testUser {
+	t.Helper()
+	api(t, "POST", "/register", "", credentials{Username: testAdmin, Password: testPassword})
+	return testUser{name: testAdmin, token: login(t, testAdmin).AccessToken}
+}
+
+func registerAs(t *testing.T, name string) testUser {
+	t.Helper()
+	if code, body := api(t, "POST", "/register", "", credentials{Username: name, Password: testPassword}); code != http.StatusCreated {
+		t.Fatalf("register %s: %d %s", name, code, body)
+	}
+	return testUser{name: name, token: login(t, name).AccessToken}
+}
+
+func login(t *testing.T, name string) tokenPair {
+	t.Helper()
+	code, body := api(t, "POST", "/login", "", credentials{Username: name, Password: testPassword})
+	if code != http.StatusOK {
+		t.Fatalf("login %s: %d %s", name, code, body)
+	}
+	var tokens tokenPair
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		t.Fatalf("login %s: %v", name, err)
+	}
+	return tokens
+}
+
+// api sends a JSON request to the test server, with token as bearer token
+// unless it is empty, and returns the status and body
+func api(t *testing.T, method, path, token string, body any) (int, []byte) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, testServer.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+// newRoom creates a private room owned by owner
+func newRoom(t *testing.T, owner testUser) string {
+	t.Helper()
+	name := uniqueName("room")
+	if code, body := api(t, "POST", "/rooms", owner.token, map[string]string{"name": name}); code != http.StatusCreated {
+		t.Fatalf("create room: %d %s", code, body)
+	}
+	return name
+}
+
+// addMember gives user a role in room, as owner
+func addMember(t *testing.T, room string, owner, user testUser, role string) {
+	t.Helper()
+	code, body := api(t, "PUT", "/rooms/"+room+"/members/"+user.name, owner.token, map[string]string{"role": role})
+	if code != http.StatusNoContent {
+		t.Fatalf("add %s to %s: %d %s", user.name, room, code, body)
+	}
+}
+
+// wsClient is a websocket connection to the test server. Frames are read
+// into a channel in the background so tests can wait for the one they need.
+type wsClient struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	room   string
+	frames chan Message
+	err    error // why reading stopped, set before frames is closed
+}
+
+// dial connects to room, authenticates as u unless u has no token, and
+// waits until the room's live messages are delivered
+func dial(t *testing.T, room string, u testUser) *wsClient {
+	t.Helper()
+	c := dialRaw(t, room, u)
+	c.sync(room)
+	return c
+}
+
+// dialRaw is dial without waiting for live delivery, for clients that may
+// not read the room
+func dialRaw(t *testing.T, room string, u testUser) *wsClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws?room=" + room
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", room, err)
+	}
+	c := &wsClient{t: t, conn: conn, room: room, frames: make(chan Message, 1024)}
+	t.Cleanup(func() { conn.Close() })
+	go c.read()
+
+	if u.token != "" {
+		c.send(Message{Type: "auth", Content: u.token})
+		c.next("auth_success")
+	}
+	return c
+}
+
+func (c *wsClient) read() {
+	defer close(c.frames)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		// writePump joins queued frames with newlines
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			var m Message
+			if json.Unmarshal(line, &m) == nil {
+				c.frames <- m
+			}
+		}
+	}
+}
+
+func (c *wsClient) send(m Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(m); err != nil {
+		c.t.Fatalf("send %s: %v", m.Type, err)
+	}
+}
+
+// next returns the next frame of type typ, skipping other frames
+func (c *wsClient) next(typ string) Message {
+	c.t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %s", typ)
+			}
+			if m.Type == typ {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatalf("no %s frame", typ)
+		}
+	}
+}
+
+// message returns the next chat message with the content, skipping others
+func (c *wsClient) message(content string) Message {
+	c.t.Helper()
+	for {
+		if m := c.next("message"); m.Content == content {
+			return m
+		}
+	}
+}
+
+// none fails if a frame of type typ arrives within d
+func (c *wsClient) none(typ string, d time.Duration) {
+	c.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case m, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			if m.Type == typ {
+				c.t.Fatalf("unexpected %s frame: %+v", typ, m)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// sync waits until the hub handled every frame sent before: a resume past
+// the end is answered by an empty replay once the room is live
+func (c *wsClient) sync(room string) {
+	c.t.Helper()
+	c.send(Message{Type: "resume", Room: room, Since: 1 << 40})
+	c.next("replay")
+}
+
+// closed waits for the server to close the connection and returns the close
+// error
+func (c *wsClient) closed() *websocket.CloseError {
+	c.t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				ce, _ := c.err.(*websocket.CloseError)
+				return ce
+			}
+		case <-timeout:
+			c.t.Fatal("connection not closed")
+		}
+	}
+}
+
+// chat sends a chat message and returns its ack
+func (c *wsClient) chat(content string) Message {
+	c.t.Helper()
+	id := uniqueName("c")
+	c.send(Message{Type: "message", Room: c.room, Content: content, ClientMsgID: id})
+	for {
+		m := c.nextOf("ack", "nack", "rate_limited")
+		if m.ClientMsgID == id {
+			return m
+		}
+	}
+}
+
+// nextOf returns the next frame of any of the types
+func (c *wsClient) nextOf(types ...string) Message {
+	c.t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %v", types)
+			}
+			for _, typ := range types {
+				if m.Type == typ {
+					return m
+				}
+			}
+		case <-timeout:
+			c.t.Fatalf("no %v frame", types)
+		}
+	}
+}
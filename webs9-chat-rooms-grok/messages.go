@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"webs9-chat-db/store"
+)
+
+// Where room messages are kept, chosen with -store. Direct messages,
+// reactions and edit history stay in SQLite.
+var messageStore store.MessageStore
+
+// openMessageStore opens the store named by spec: "sqlite" for the messages
+// table of db, or anything store.Open accepts
+func openMessageStore(spec string) (store.MessageStore, error) {
+	if spec == "sqlite" {
+		return sqliteStore{db: db}, nil
+	}
+	return store.Open(spec)
+}
+
+// toStored converts a chat message for the store
+func toStored(m Message) store.Message {
+	return store.Message{
+		Room:        m.Room,
+		UserID:      m.userID,
+		Username:    m.Username,
+		Content:     m.Content,
+		ClientMsgID: m.ClientMsgID,
+		ParentID:    m.ParentID,
+		Timestamp:   time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// fromStored converts a stored message for clients
+func fromStored(sm store.Message) Message {
+	m := Message{
+		Type:       "message",
+		ID:         sm.ID,
+		Username:   sm.Username,
+		Room:       sm.Room,
+		Content:    sm.Content,
+		Seq:        sm.Seq,
+		Timestamp:  sm.Timestamp.Format(time.RFC3339),
+		Deleted:    sm.Deleted,
+		ParentID:   sm.ParentID,
+		ReplyCount: sm.ReplyCount,
+	}
+	if !sm.EditedAt.IsZero() {
+		m.EditedAt = sm.EditedAt.Format(time.RFC3339)
+	}
+	return m
+}
+
+// fromStoredWithReactions converts stored messages and fills in their
+// reaction counts
+func fromStoredWithReactions(stored []store.Message) ([]Message, error) {
+	msgs := make([]Message, len(stored))
+	for i, sm := range stored {
+		msgs[i] = fromStored(sm)
+	}
+	if err := attachReactions(msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func getRecentMessages(room string, limit int) []Message {
+	msgs, err := getMessagesBefore(room, 0, limit)
+	if err != nil {
+		slog.Error("DB history error", "err", err)
+	}
+	return msgs
+}
+
+// getMessagesBefore returns up to limit messages of room older than the
+// message with ID before (0 for the newest), in chronological order
+func getMessagesBefore(room string, before int64, limit int) ([]Message, error) {
+	stored, err := messageStore.Before(room, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return fromStoredWithReactions(stored)
+}
+
+// getMessagesInSeqRange returns the messages of room with after < seq <= upTo
+func getMessagesInSeqRange(room string, after, upTo int64) ([]Message, error) {
+	stored, err := messageStore.Range(room, after, upTo)
+	if err != nil {
+		return nil, err
+	}
+	return fromStoredWithReactions(stored)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAck(t *testing.T) {
+	u, other := newUser(t), newUser(t)
+	c, oc := dial(t, publicRoom, u), dial(t, publicRoom, other)
+
+	ack := c.chat("hello")
+	if ack.Type != "ack" || ack.ID == 0 || ack.Seq == 0 || ack.Room != publicRoom {
+		t.Fatalf("ack = %+v", ack)
+	}
+	if m := oc.message("hello"); m.ID != ack.ID || m.Seq != ack.Seq || m.Username != u.name {
+		t.Errorf("delivered %+v, want the acked message", m)
+	}
+	if next := c.chat("again"); next.Seq <= ack.Seq {
+		t.Errorf("seq %d after %d", next.Seq, ack.Seq)
+	}
+}
+
+func TestResendIsIdempotent(t *testing.T) {
+	u, other := newUser(t), newUser(t)
+	c, oc := dial(t, publicRoom, u), dial(t, publicRoom, other)
+
+	msg := Message{Type: "message", Room: publicRoom, Content: "once", ClientMsgID: uniqueName("c")}
+	c.send(msg)
+	first := c.next("ack")
+	oc.message("once")
+
+	// The retry of a message that was stored is acked with the stored copy
+	// and not delivered again
+	c.send(msg)
+	if again := c.next("ack"); again.ID != first.ID || again.Seq != first.Seq {
+		t.Errorf("retry acked as %+v, want %+v", again, first)
+	}
+	oc.none("message", 200*time.Millisecond)
+
+	// The same ID from another user is another message
+	oc.send(msg)
+	if m := oc.next("ack"); m.ID == first.ID {
+		t.Error("another user's message deduplicated")
+	}
+}
+
+func TestNack(t *testing.T) {
+	u := newUser(t)
+	c := dial(t, publicRoom, u)
+	cases := []struct {
+		msg  Message
+		code string
+	}{
+		{Message{Room: publicRoom}, "invalid"},
+		{Message{Room: publicRoom, Content: "x", ClientMsgID: strings.Repeat("c", maxClientMsgIDLen+1)}, "invalid"},
+		{Message{Room: uniqueName("room"), Content: "x"}, "not_subscribed"},
+	}
+	for _, tc := range cases {
+		tc.msg.Type = "message"
+		if tc.msg.ClientMsgID == "" {
+			tc.msg.ClientMsgID = uniqueName("c")
+		}
+		c.send(tc.msg)
+		if m := c.nextOf("ack", "nack"); m.Type != "nack" || m.Code != tc.code || m.ClientMsgID != tc.msg.ClientMsgID {
+			t.Errorf("%+v: got %+v, want a %s nack", tc.msg, m, tc.code)
+		}
+	}
+}
+
+// A retry sent while the first copy waits for the writer isn't queued again
+func TestInflightRetry(t *testing.T) {
+	h := newTestHub()
+	from := testClient(h)
+	m := Message{Type: "message", Room: uniqueName("room"), Content: "x", ClientMsgID: uniqueName("c"), userID: "1", from: from}
+	h.publish(m)
+	h.publish(m)
+	if n := len(h.writer.queue); n != 1 {
+		t.Fatalf("%d messages queued, want 1", n)
+	}
+
+	h.persisted(h.writer.write([]Message{<-h.writer.queue}))
+	h.publish(m)
+	results := h.writer.write([]Message{<-h.writer.queue})
+	if !results[0].duplicate {
+		t.Errorf("retry after the write stored as %+v, want a duplicate", results[0].message)
+	}
+}
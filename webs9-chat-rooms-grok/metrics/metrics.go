@@ -0,0 +1,109 @@
+// Package metrics holds the Prometheus metrics of the websocket servers, so
+// every server exports the same names. Servers without rooms use "" as the
+// room label.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Room labels are cut to maxRoomLabelLen bytes, and once maxRoomLabels rooms
+// have open connections further rooms are counted under OtherRooms
+const (
+	maxRoomLabels   = 100
+	maxRoomLabelLen = 64
+	OtherRooms      = "_other"
+)
+
+var (
+	connections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_connections",
+		Help: "Open websocket connections per room.",
+	}, []string{"room"})
+
+	// Open connections per room label
+	roomLabels   = make(map[string]int)
+	roomLabelsMu sync.Mutex
+
+	MessagesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_messages_received_total",
+		Help: "Frames read from clients.",
+	})
+
+	MessagesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_messages_sent_total",
+		Help: "Messages written to clients.",
+	})
+
+	SendDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_send_buffer_drops_total",
+		Help: "Clients dropped because their send buffer was full.",
+	})
+
+	DBWriteSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_db_write_duration_seconds",
+		Help:    "Time taken to store chat messages, per write.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+
+	AuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_auth_failures_total",
+		Help: "Rejected logins and tokens.",
+	})
+
+	UpgradeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_upgrade_errors_total",
+		Help: "Failed websocket handshakes.",
+	})
+)
+
+// ConnectionOpened counts a connection to room in ws_connections and returns
+// the function that uncounts it. A room's label is removed once its last
+// connection closes, so rooms come and go without leaving series behind.
+func ConnectionOpened(room string) (closed func()) {
+	label := strings.ToValidUTF8(room, "?")
+	if len(label) > maxRoomLabelLen {
+		label = strings.ToValidUTF8(label[:maxRoomLabelLen], "")
+	}
+
+	roomLabelsMu.Lock()
+	defer roomLabelsMu.Unlock()
+	if _, ok := roomLabels[label]; !ok && len(roomLabels) >= maxRoomLabels {
+		label = OtherRooms
+	}
+	roomLabels[label]++
+	connections.WithLabelValues(label).Inc()
+
+	return func() {
+		roomLabelsMu.Lock()
+		defer roomLabelsMu.Unlock()
+		roomLabels[label]--
+		if roomLabels[label] > 0 {
+			connections.WithLabelValues(label).Dec()
+			return
+		}
+		delete(roomLabels, label)
+		connections.DeleteLabelValues(label)
+	}
+}
+
+// WatchBroadcastQueue exports the length of a hub's broadcast channel, read
+// at scrape time. The channel must be buffered; an unbuffered one always
+// reads 0.
+func WatchBroadcastQueue(depth func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ws_broadcast_queue_depth",
+		Help: "Messages waiting in the hub's broadcast channel.",
+	}, func() float64 { return float64(depth()) })
+}
+
+// Handler serves the metrics for /metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
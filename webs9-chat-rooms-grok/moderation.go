@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"webs9-chat-db/logging"
+)
+
+// Sanction kinds stored in the sanctions table
+const (
+	sanctionMute = "mute"
+	sanctionBan  = "ban"
+)
+
+// Room of server-wide sanctions, which only admins give
+const serverWide = ""
+
+const (
+	defaultMute = 10 * time.Minute
+	maxMute     = 30 * 24 * time.Hour
+	maxBan      = 10 * 365 * 24 * time.Hour // longer bans are cut to this
+)
+
+var errSelfSanction = errors.New("can't moderate yourself")
+
+// sanctioned reports whether an active sanction of kind applies to userID or
+// ip in room. Either may be empty.
+func sanctioned(kind, room, userID, ip string) (bool, error) {
+	if userID == "" && ip == "" {
+		return false, nil
+	}
+	var found bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM sanctions
+			WHERE kind = ? AND room = ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+			AND (user_id = ? OR ip = ?))`,
+		kind, room, time.Now().Unix(), nullIfEmpty(userID), nullIfEmpty(ip)).Scan(&found)
+	return found, err
+}
+
+// applySanctions lowers a role for the bans and mutes on userID or ip: banned
+// users can't read the room, muted ones can't write
+func applySanctions(r role, room, userID, ip string) (role, error) {
+	if r == roleNone {
+		return r, nil
+	}
+	for _, scope := range []string{room, serverWide} {
+		banned, err := sanctioned(sanctionBan, scope, userID, ip)
+		if err != nil {
+			return roleNone, err
+		}
+		if banned {
+			return roleNone, nil
+		}
+	}
+	muted, err := sanctioned(sanctionMute, room, userID, ip)
+	if err != nil {
+		return roleNone, err
+	}
+	if muted {
+		return min(r, roleReadOnly), nil
+	}
+	return r, nil
+}
+
+// canModerate checks that actor may sanction targetID in room: admins
+// anywhere, otherwise moderators and owners over users of a lower role. The
+// public room has no moderators, so only admins moderate it.
+func canModerate(room string, actor *session, targetID string) error {
+	if targetID == actor.userID {
+		return errSelfSanction
+	}
+	if isAdmin(actor) {
+		return nil
+	}
+	if room == serverWide {
+		return errForbidden
+	}
+	actorRole, err := memberRole(room, actor.userID)
+	if err != nil {
+		return err
+	}
+	targetRole, err := memberRole(room, targetID)
+	if err != nil {
+		return err
+	}
+	if actorRole < roleModerator || targetRole >= actorRole {
+		return errForbidden
+	}
+	return nil
+}
+
+// sanction is a moderation action to record and enforce
+type sanction struct {
+	action   string // mute, unmute, kick, ban, unban
+	room     string
+	actor    *session
+	userID   string
+	username string
+	ips      []string // banned along with the user, or alone for server-wide bans
+	reason   string
+	duration time.Duration // 0 for permanent bans
+}
+
+// apply stores the sanction or lifts earlier ones, and writes the audit entry
+func (s sanction) apply() (expires time.Time, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var expiresAt any
+	if s.duration > 0 {
+		expires = time.Now().Add(s.duration).Truncate(time.Second)
+		expiresAt = expires.Unix()
+	}
+
+	switch s.action {
+	case "mute", "ban":
+		targets := [][2]any{}
+		if s.userID != "" {
+			targets = append(targets, [2]any{s.userID, nil})
+		}
+		for _, ip := range s.ips {
+			targets = append(targets, [2]any{nullIfEmpty(s.userID), ip})
+		}
+		for _, t := range targets {
+			_, err := tx.Exec("INSERT INTO sanctions (kind, room, user_id, ip, reason, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				s.action, s.room, t[0], t[1], nullIfEmpty(s.reason), s.actor.userID, expiresAt)
+			if err != nil {
+				return time.Time{}, err
+			}
+		}
+
+	case "unmute", "unban":
+		kind := sanctionMute
+		if s.action == "unban" {
+			kind = sanctionBan
+		}
+		args := []any{s.actor.userID, kind, s.room, nullIfEmpty(s.userID)}
+		query := "UPDATE sanctions SET lifted_at = CURRENT_TIMESTAMP, lifted_by = ? WHERE kind = ? AND room = ? AND lifted_at IS NULL AND (user_id = ?"
+		for _, ip := range s.ips {
+			query += " OR ip = ?"
+			args = append(args, ip)
+		}
+		if _, err := tx.Exec(query+")", args...); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var ip any
+	if len(s.ips) > 0 {
+		ip = s.ips[0]
+	}
+	_, err = tx.Exec("INSERT INTO moderation_log (room, action, actor_id, target_id, target_ip, reason, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.room, s.action, s.actor.userID, nullIfEmpty(s.userID), ip, nullIfEmpty(s.reason), expiresAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expires, tx.Commit()
+}
+
+// enforce tells the affected clients and the room about an applied sanction
+func (s sanction) enforce(expires time.Time) {
+	switch s.action {
+	case "kick":
+		hub.kick <- kickRequest{room: s.room, userID: s.userID, code: "kicked", reason: "kicked from room"}
+	case "ban":
+		hub.kick <- kickRequest{room: s.room, userID: s.userID, ips: s.ips, code: "banned", reason: "banned"}
+	case "mute", "unmute", "unban":
+		if s.userID != "" && s.room != serverWide {
+			hub.memberChanged <- memberChange{room: s.room, userID: s.userID}
+		}
+	}
+	if s.action == "mute" {
+		scheduleUnmute(s.room, s.userID, s.username, expires)
+	}
+	if s.room != serverWide && s.username != "" {
+		hub.notify <- s.notice()
+	}
+}
+
+// notice is the system message telling the room about the sanction
+func (s sanction) notice() Message {
+	text := s.username
+	switch s.action {
+	case "mute":
+		text += " was muted for " + s.duration.String()
+	case "unmute":
+		text += " is no longer muted"
+	case "kick":
+		text += " was kicked"
+	case "ban":
+		text += " was banned"
+		if s.duration > 0 {
+			text += " for " + s.duration.String()
+		}
+	case "unban":
+		text += " was unbanned"
+	}
+	text += " by " + s.actor.username
+	if s.reason != "" {
+		text += ": " + s.reason
+	}
+	return Message{Type: "system", Code: s.action, Room: s.room, Username: s.username, Content: text, Timestamp: time.Now().Format(time.RFC3339)}
+}
+
+// scheduleUnmute tells the room and refreshes the user's role once a mute
+// runs out, unless it was lifted or extended meanwhile
+func scheduleUnmute(room, userID, username string, expires time.Time) {
+	time.AfterFunc(time.Until(expires)+time.Second, func() {
+		// Lifted mutes were announced by unmute already
+		var ran bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sanctions WHERE kind = ? AND room = ? AND user_id = ? AND lifted_at IS NULL AND expires_at = ?)",
+			sanctionMute, room, userID, expires.Unix()).Scan(&ran)
+		if err != nil {
+			slog.Error("DB sanction error", "err", err)
+			return
+		}
+		muted, err := sanctioned(sanctionMute, room, userID, "")
+		if err != nil {
+			slog.Error("DB sanction error", "err", err)
+			return
+		}
+		if !ran || muted {
+			return
+		}
+		hub.memberChanged <- memberChange{room: room, userID: userID}
+		hub.notify <- Message{Type: "system", Code: "unmute", Room: room, Username: username, Content: username + " is no longer muted", Timestamp: time.Now().Format(time.RFC3339)}
+	})
+}
+
+// loadMuteTimers schedules the end of the mutes running at startup
+func loadMuteTimers() {
+	rows, err := db.Query(`
+		SELECT s.room, s.user_id, u.username, MAX(s.expires_at) FROM sanctions s JOIN users u ON u.id = s.user_id
+		WHERE s.kind = ? AND s.lifted_at IS NULL AND s.expires_at > ?
+		GROUP BY s.room, s.user_id`, sanctionMute, time.Now().Unix())
+	if err != nil {
+		logging.Fatal("Loading mutes", "err", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var room, userID, username string
+		var expires int64
+		if err := rows.Scan(&room, &userID, &username, &expires); err != nil {
+			logging.Fatal("Loading mutes", "err", err)
+		}
+		scheduleUnmute(room, userID, username, time.Unix(expires, 0))
+	}
+	if err := rows.Err(); err != nil {
+		logging.Fatal("Loading mutes", "err", err)
+	}
+}
+
+// kickRequest asks the hub to drop a user's or IP's subscriptions to room,
+// or all of their connections for server-wide bans
+type kickRequest struct {
+	room   string
+	userID string
+	ips    []string
+	code   string
+	reason string
+}
+
+// kickAll kicks on this node and, through the bus, on the others
+func (h *Hub) kickAll(req kickRequest) {
+	h.kickClients(req)
+	h.share(busEvent{Kind: busKick, Message: Message{Room: req.room, Code: req.code, Content: req.reason}, UserID: req.userID, IPs: req.ips})
+}
+
+// kickClients kicks the matching clients of this node
+func (h *Hub) kickClients(req kickRequest) {
+	// Like clientRole, address matches spare moderators and admins
+	matches := func(c *Client, r role) bool {
+		s := c.sess.Load()
+		if req.userID != "" && s != nil && s.userID == req.userID {
+			return true
+		}
+		return slices.Contains(req.ips, c.ip) && r < roleModerator && !isAdmin(s)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if req.room == serverWide {
+		for client := range h.clients {
+			if matches(client, roleNone) {
+				client.log.Info("Kicked from server", "reason", req.reason)
+				h.removeClient(client, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, req.reason))
+			}
+		}
+		return
+	}
+	for client, sub := range h.rooms[req.room] {
+		if matches(client, sub.role) {
+			client.log.Info("Kicked from room", "room", req.room, "reason", req.reason)
+			h.revokeSubscription(sub, req.code, req.reason)
+		}
+	}
+}
+
+// userIPs returns the addresses userID is connected from. It is safe to call
+// from any goroutine.
+func (h *Hub) userIPs(userID string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var ips []string
+	for client := range h.users[userID] {
+		if !slices.Contains(ips, client.ip) {
+			ips = append(ips, client.ip)
+		}
+	}
+	return ips
+}
+
+// sanctionDuration converts a duration in seconds from a request, cut to
+// maxBan before converting so it can't overflow. Negative values are
+// invalid.
+func sanctionDuration(seconds int64) (time.Duration, bool) {
+	if seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(min(seconds, int64(maxBan/time.Second))) * time.Second, true
+}
+
+func moderationErrorText(err error) string {
+	switch {
+	case errors.Is(err, errForbidden), errors.Is(err, errNoSuchUser), errors.Is(err, errSelfSanction):
+		return err.Error()
+	default:
+		slog.Error("DB moderation error", "err", err)
+		return "Internal error"
+	}
+}
+
+// moderate handles the websocket "mute", "unmute", "kick", "ban" and "unban"
+// commands for room. Bans also cover the addresses the user is connected from.
+func (c *Client) moderate(msg Message, room string) {
+	actor := c.sess.Load()
+	if actor == nil {
+		c.reply(Message{Type: "error", Content: "Auth required"})
+		return
+	}
+	duration, ok := sanctionDuration(msg.Duration)
+	if !ok {
+		c.reply(Message{Type: "error", Room: room, Content: "Invalid duration"})
+		return
+	}
+	userID, err := lookupUserID(msg.Username)
+	if err == nil {
+		err = canModerate(room, actor, userID)
+	}
+	if err != nil {
+		c.reply(Message{Type: "error", Room: room, Content: moderationErrorText(err)})
+		return
+	}
+
+	s := sanction{
+		action:   msg.Type,
+		room:     room,
+		actor:    actor,
+		userID:   userID,
+		username: msg.Username,
+		reason:   msg.Content,
+		duration: duration,
+	}
+	switch s.action {
+	case "mute":
+		if s.duration <= 0 {
+			s.duration = defaultMute
+		}
+		s.duration = min(s.duration, maxMute)
+	case "ban":
+		s.ips = hub.userIPs(userID)
+	}
+
+	expires, err := s.apply()
+	if err != nil {
+		c.reply(Message{Type: "error", Room: room, Content: moderationErrorText(err)})
+		return
+	}
+	s.enforce(expires)
+	c.reply(Message{Type: s.action + "_success", Room: room, Username: msg.Username, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// serverBanHandler serves POST and DELETE /admin/bans, banning or unbanning a
+// username and/or an IP address from the whole server
+func serverBanHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+		Duration int64  `json:"duration"` // seconds, 0 for permanent
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.IP == "") {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	duration, ok := sanctionDuration(req.Duration)
+	if !ok {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s := sanction{action: "ban", room: serverWide, actor: actor, reason: req.Reason, duration: duration}
+	if r.Method == http.MethodDelete {
+		s.action = "unban"
+	}
+	if req.IP != "" {
+		s.ips = []string{req.IP}
+	}
+	if req.Username != "" {
+		var err error
+		if s.userID, err = lookupUserID(req.Username); err != nil {
+			memberError(w, err)
+			return
+		}
+		if err := canModerate(serverWide, actor, s.userID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.username = req.Username
+	}
+
+	expires, err := s.apply()
+	if err != nil {
+		slog.Error("DB moderation error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	s.enforce(expires)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type auditEntry struct {
+	ID        int64  `json:"id"`
+	Room      string `json:"room,omitempty"`
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	Target    string `json:"target,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// loadAudit returns the newest moderation log entries, of one room or of
+// all if room is nil. IPs are only included for admins.
+func loadAudit(room *string, withIP bool, limit int) ([]auditEntry, error) {
+	query := `
+		SELECT l.id, l.room, l.action, a.username, COALESCE(t.username, ''), COALESCE(l.target_ip, ''),
+			COALESCE(l.reason, ''), COALESCE(l.expires_at, 0), l.created_at
+		FROM moderation_log l JOIN users a ON a.id = l.actor_id LEFT JOIN users t ON t.id = l.target_id`
+	args := []any{}
+	if room != nil {
+		query += " WHERE l.room = ?"
+		args = append(args, *room)
+	}
+	query += " ORDER BY l.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.Room, &e.Action, &e.Actor, &e.Target, &e.IP, &e.Reason, &e.ExpiresAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if !withIP {
+			e.IP = ""
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditHandler serves GET /rooms/{room}/audit?limit=N to the room's
+// moderators and GET /admin/audit?limit=N to admins
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var room *string
+	if name := r.PathValue("room"); name != "" {
+		room = &name
+		if rl, err := memberRole(name, s.userID); !isAdmin(s) && (err != nil || rl < roleModerator) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	} else if !isAdmin(s) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := loadAudit(room, isAdmin(s), pageSize(limit))
+	if err != nil {
+		slog.Error("DB audit error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSanctionDuration(t *testing.T) {
+	cases := []struct {
+		seconds int64
+		want    time.Duration
+		ok      bool
+	}{
+		{-1, 0, false},
+		{0, 0, true},
+		{60, time.Minute, true},
+		{1 << 62, maxBan, true},
+	}
+	for _, c := range cases {
+		if got, ok := sanctionDuration(c.seconds); got != c.want || ok != c.ok {
+			t.Errorf("sanctionDuration(%d) = %v, %v, want %v, %v", c.seconds, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// moderate sends a moderation command and returns the reply
+func (c *wsClient) moderate(action, username string) Message {
+	c.t.Helper()
+	c.send(Message{Type: action, Room: c.room, Username: username})
+	return c.nextOf(action+"_success", "error")
+}
+
+func TestMute(t *testing.T) {
+	owner, mod, u := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, mod, "moderator")
+	addMember(t, room, owner, u, "member")
+	mc, c := dial(t, room, mod), dial(t, room, u)
+
+	if m := mc.moderate("mute", u.name); m.Type != "mute_success" {
+		t.Fatalf("mute: %+v", m)
+	}
+	if m := c.next("role_changed"); m.Role != "read-only" {
+		t.Errorf("muted user's role = %q, want read-only", m.Role)
+	}
+	if m := mc.next("system"); m.Code != "mute" || m.Username != u.name {
+		t.Errorf("notice = %+v", m)
+	}
+	if m := c.chat("let me speak"); m.Type != "nack" || m.Code != "forbidden" {
+		t.Errorf("muted user's message: %+v", m)
+	}
+
+	mc.moderate("unmute", u.name)
+	if m := c.next("role_changed"); m.Role != "member" {
+		t.Errorf("unmuted user's role = %q, want member", m.Role)
+	}
+	if m := c.chat("thanks"); m.Type != "ack" {
+		t.Errorf("unmuted user's message: %+v", m)
+	}
+
+	// Moderators only act on lower roles, and never on themselves
+	for _, target := range []string{owner.name, mod.name} {
+		if m := mc.moderate("mute", target); m.Type != "error" {
+			t.Errorf("moderator muting %s: %+v", target, m)
+		}
+	}
+	if m := dial(t, room, u).moderate("mute", mod.name); m.Content != errForbidden.Error() {
+		t.Errorf("member muting a moderator: %+v", m)
+	}
+}
+
+func TestKickAndBan(t *testing.T) {
+	owner, u := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, u, "member")
+	oc, c := dial(t, room, owner), dial(t, room, u)
+
+	// Kicked users may come back
+	oc.moderate("kick", u.name)
+	if ce := c.closed(); ce == nil || ce.Code != closeRoomForbidden {
+		t.Errorf("kicked user closed with %v, want %d", ce, closeRoomForbidden)
+	}
+	c = dial(t, room, u)
+
+	oc.moderate("ban", u.name)
+	if ce := c.closed(); ce == nil || ce.Code != closeRoomForbidden {
+		t.Errorf("banned user closed with %v, want %d", ce, closeRoomForbidden)
+	}
+	if code, _ := api(t, "GET", "/rooms/"+room+"/messages", u.token, nil); code != http.StatusForbidden {
+		t.Errorf("banned user's history: %d, want 403", code)
+	}
+	if m := dialRaw(t, room, u).chat("back"); m.Type != "nack" {
+		t.Errorf("banned user's message: %+v", m)
+	}
+
+	oc.moderate("unban", u.name)
+	if m := dial(t, room, u).chat("back"); m.Type != "ack" {
+		t.Errorf("message after unban: %+v", m)
+	}
+
+	var entries []auditEntry
+	code, body := api(t, "GET", "/rooms/"+room+"/audit", owner.token, nil)
+	if code != http.StatusOK || json.Unmarshal(body, &entries) != nil || len(entries) != 3 {
+		t.Fatalf("audit: %d %s", code, body)
+	}
+	if e := entries[1]; e.Action != "ban" || e.Actor != owner.name || e.Target != u.name || e.IP != "" {
+		t.Errorf("ban entry = %+v, want one without the address", e)
+	}
+	if code, _ := api(t, "GET", "/rooms/"+room+"/audit", u.token, nil); code != http.StatusForbidden {
+		t.Errorf("member's audit: %d, want 403", code)
+	}
+}
+
+func TestServerBan(t *testing.T) {
+	admin, u := adminUser(t), newUser(t)
+	c := dial(t, publicRoom, u)
+
+	ban := map[string]any{"username": u.name, "reason": "spam"}
+	if code, body := api(t, "POST", "/admin/bans", admin.token, ban); code != http.StatusNoContent {
+		t.Fatalf("ban: %d %s", code, body)
+	}
+	if ce := c.closed(); ce == nil || ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("banned user closed with %v, want %d", ce, websocket.ClosePolicyViolation)
+	}
+	c = dialRaw(t, publicRoom, testUser{})
+	c.send(Message{Type: "auth", Content: u.token})
+	if ce := c.closed(); ce == nil || ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("banned user's auth closed with %v, want %d", ce, websocket.ClosePolicyViolation)
+	}
+
+	if code, _ := api(t, "DELETE", "/admin/bans", admin.token, ban); code != http.StatusNoContent {
+		t.Fatalf("unban: %d", code)
+	}
+	if m := dial(t, publicRoom, u).chat("back"); m.Type != "ack" {
+		t.Errorf("message after unban: %+v", m)
+	}
+
+	// Address bans are recorded with the address, which only admins see
+	ipBan := map[string]any{"ip": "203.0.113.9", "duration": 60}
+	if code, _ := api(t, "POST", "/admin/bans", admin.token, ipBan); code != http.StatusNoContent {
+		t.Errorf("IP ban: %d", code)
+	}
+	var entries []auditEntry
+	code, body := api(t, "GET", "/admin/audit?limit=1", admin.token, nil)
+	if code != http.StatusOK || json.Unmarshal(body, &entries) != nil || len(entries) != 1 || entries[0].IP != "203.0.113.9" || entries[0].ExpiresAt == 0 {
+		t.Errorf("admin audit: %d %s", code, body)
+	}
+	api(t, "DELETE", "/admin/bans", admin.token, ipBan)
+
+	cases := []struct {
+		token string
+		body  any
+		want  int
+	}{
+		{u.token, ban, http.StatusForbidden},
+		{admin.token, map[string]any{}, http.StatusBadRequest},
+		{admin.token, map[string]any{"username": u.name, "duration": -1}, http.StatusBadRequest},
+		{admin.token, map[string]any{"username": admin.name}, http.StatusBadRequest},
+		{admin.token, map[string]any{"username": uniqueName("nobody")}, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if code, _ := api(t, "POST", "/admin/bans", tc.token, tc.body); code != tc.want {
+			t.Errorf("ban %+v: %d, want %d", tc.body, code, tc.want)
+		}
+	}
+}
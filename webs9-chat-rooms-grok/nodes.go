@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"webs9-chat-db/bus"
+)
+
+// ID of this node on the bus, from -node-id or random
+var nodeID string
+
+// Kinds of bus events
+const (
+	busRoom      = "room"      // chat message or room event, for the room's clients
+	busEphemeral = "ephemeral" // typing indicator, for the room's clients but the typist
+	busDirect    = "direct"    // direct message, for the sender's and recipient's clients
+	busKick      = "kick"      // kick, ban or logout: room, code and reason in the message
+	busMember    = "member"    // user's role in the message's room changed
+	busRevoke    = "revoke"    // access token JTI revoked, or the user's tokens issued before At
+	busPresence  = "presence"  // user connected to the message's room on the origin node, or no longer
+	busHello     = "hello"     // origin node started, with no clients yet
+)
+
+// busEvent is what a node tells the others after delivering something to
+// its own clients or changing what they may do. The user IDs carry what
+// Message keeps unexported.
+type busEvent struct {
+	Kind     string   `json:"kind"`
+	Message  Message  `json:"message"`
+	UserID   string   `json:"user_id,omitempty"`    // typist, DM sender, or the user kicked, revoked or present
+	ToUserID string   `json:"to_user_id,omitempty"` // DM recipient
+	IPs      []string `json:"ips,omitempty"`        // banned addresses
+	JTI      string   `json:"jti,omitempty"`        // revoked access token
+	At       int64    `json:"at,omitempty"`         // revoked token's expiry, or the user's logout
+	Present  bool     `json:"present,omitempty"`
+}
+
+// share publishes an event to the other nodes. It is safe to call from any
+// goroutine. The bus never blocks; an event it can't take is lost for the
+// other nodes.
+func (h *Hub) share(ev busEvent) {
+	if h.bus == nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Bus encode error", "err", err)
+		return
+	}
+	if err := h.bus.Publish(bus.Envelope{Origin: nodeID, Room: ev.Message.Room, Data: data}); err != nil {
+		slog.Warn("Bus publish error", "kind", ev.Kind, "room", ev.Message.Room, "err", err)
+	}
+}
+
+// fromBus delivers an event of another node to the clients of this one. The
+// node's own events come back too and are skipped, as they were delivered
+// when shared.
+func (h *Hub) fromBus(e bus.Envelope) {
+	if e.Origin == nodeID {
+		return
+	}
+	var ev busEvent
+	if err := json.Unmarshal(e.Data, &ev); err != nil {
+		slog.Warn("Bus event dropped", "origin", e.Origin, "err", err)
+		return
+	}
+
+	switch ev.Kind {
+	case busRoom:
+		h.seenSeq(ev.Message)
+		h.deliverRoom(ev.Message)
+	case busEphemeral:
+		h.deliverEphemeral(ev.Message, ev.UserID)
+	case busDirect:
+		m := ev.Message
+		m.userID, m.toUserID = ev.UserID, ev.ToUserID
+		h.deliverLocalDM(m)
+	case busKick:
+		h.kickClients(kickRequest{room: ev.Message.Room, userID: ev.UserID, ips: ev.IPs, code: ev.Message.Code, reason: ev.Message.Content})
+	case busMember:
+		h.applyMemberChange(memberChange{room: ev.Message.Room, userID: ev.UserID})
+	case busRevoke:
+		if ev.JTI != "" {
+			cacheRevokedToken(ev.JTI, time.Unix(ev.At, 0))
+		} else {
+			cacheLogout(ev.UserID, time.Unix(ev.At, 0))
+		}
+		h.closeExpiredSessions()
+	case busPresence:
+		h.remotePresence(e.Origin, ev.Message.Room, ev.UserID, ev.Message.Username, ev.Present)
+	case busHello:
+		h.nodeStarted(e.Origin)
+	default:
+		slog.Warn("Bus event dropped", "origin", e.Origin, "kind", ev.Kind)
+	}
+}
+
+// seenSeq moves the room's delivered seq past a chat message another node
+// stored, so replays include it
+func (h *Hub) seenSeq(m Message) {
+	if m.Type != "message" || m.Seq == 0 {
+		return
+	}
+	h.delivered[m.Room] = max(h.deliveredSeq(m.Room), m.Seq)
+}
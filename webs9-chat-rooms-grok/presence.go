@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// presenceEntry counts one user's live connections to a room on this node
+// and records the other nodes they are connected through, so a user with
+// several tabs, on any nodes, joins once and leaves with the last tab
+type presenceEntry struct {
+	username string
+	conns    int
+	nodes    map[string]bool
+}
+
+func (e *presenceEntry) online() bool {
+	return e.conns > 0 || len(e.nodes) > 0
+}
+
+// presenceEntry returns userID's entry in room, creating it. h.presenceMu
+// must be held.
+func (h *Hub) presenceEntry(room, userID, username string) *presenceEntry {
+	users := h.presence[room]
+	if users == nil {
+		users = make(map[string]*presenceEntry)
+		h.presence[room] = users
+	}
+	entry := users[userID]
+	if entry == nil {
+		entry = &presenceEntry{username: username, nodes: make(map[string]bool)}
+		users[userID] = entry
+	}
+	return entry
+}
+
+// announce tells the room's clients on this node that a user joined or
+// left. Every node announces to its own clients, so announcements aren't
+// shared.
+func (h *Hub) announce(typ, room, username string) {
+	h.emit(Message{Type: typ, Room: room, Username: username, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// left forgets userID and announces them leaving once they are connected
+// nowhere. h.presenceMu must be held.
+func (h *Hub) left(room, userID string, entry *presenceEntry) {
+	if entry.online() {
+		return
+	}
+	users := h.presence[room]
+	delete(users, userID)
+	if len(users) == 0 {
+		delete(h.presence, room)
+	}
+	h.announce("presence_leave", room, entry.username)
+}
+
+// markPresent counts a live, authenticated subscription towards its room's
+// roster, announces the user when this is their first connection anywhere
+// and tells the other nodes when it is their first on this one
+func (h *Hub) markPresent(sub *subscription) {
+	s := sub.client.sess.Load()
+	if s == nil || !sub.live || sub.present {
+		return
+	}
+	sub.present = true
+
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	entry := h.presenceEntry(sub.room, s.userID, s.username)
+	if !entry.online() {
+		h.announce("presence_join", sub.room, s.username)
+	}
+	entry.conns++
+	if entry.conns == 1 {
+		h.sharePresence(sub.room, s.userID, entry.username, true)
+	}
+}
+
+// markAbsent undoes markPresent and announces the user once their last
+// connection anywhere is gone
+func (h *Hub) markAbsent(sub *subscription) {
+	if !sub.present {
+		return
+	}
+	sub.present = false
+	s := sub.client.sess.Load()
+
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	entry := h.presence[sub.room][s.userID]
+	if entry == nil || entry.conns == 0 {
+		return
+	}
+	entry.conns--
+	if entry.conns > 0 {
+		return
+	}
+	h.sharePresence(sub.room, s.userID, entry.username, false)
+	h.left(sub.room, s.userID, entry)
+}
+
+func (h *Hub) sharePresence(room, userID, username string, present bool) {
+	h.share(busEvent{Kind: busPresence, Message: Message{Room: room, Username: username}, UserID: userID, Present: present})
+}
+
+// remotePresence records that userID connected to room on another node, or
+// is no longer connected there
+func (h *Hub) remotePresence(node, room, userID, username string, present bool) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	if present {
+		entry := h.presenceEntry(room, userID, username)
+		if !entry.online() {
+			h.announce("presence_join", room, username)
+		}
+		entry.nodes[node] = true
+		return
+	}
+	entry := h.presence[room][userID]
+	if entry == nil || !entry.nodes[node] {
+		return
+	}
+	delete(entry.nodes, node)
+	h.left(room, userID, entry)
+}
+
+// nodeStarted forgets the users of a node that (re)started, as it has no
+// clients yet, and shares this node's users with it. A node that stops
+// shares its users leaving; one that crashes and restarts with another
+// -node-id leaves its users online until their rooms are empty elsewhere
+// too.
+func (h *Hub) nodeStarted(node string) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	for room, users := range h.presence {
+		for userID, entry := range users {
+			if entry.nodes[node] {
+				delete(entry.nodes, node)
+				h.left(room, userID, entry)
+			}
+			if entry.conns > 0 {
+				h.sharePresence(room, userID, entry.username, true)
+			}
+		}
+	}
+}
+
+// roster lists the usernames online in room. It is safe to call from any
+// goroutine.
+func (h *Hub) roster(room string) []string {
+	h.presenceMu.RLock()
+	defer h.presenceMu.RUnlock()
+
+	users := []string{}
+	for _, entry := range h.presence[room] {
+		users = append(users, entry.username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// emit queues a room event for this node's clients; run delivers it once
+// the current step is done, so events can be raised while h.mu is held
+func (h *Hub) emit(event Message) {
+	h.pending = append(h.pending, event)
+}
+
+func (h *Hub) flushEvents() {
+	for len(h.pending) > 0 {
+		event := h.pending[0]
+		h.pending = h.pending[1:]
+		h.deliverRoom(event)
+	}
+}
+
+// sendRoster answers a websocket "who" request
+func (c *Client) sendRoster(room string) {
+	if !clientRole(c, room).canRead() {
+		c.reply(Message{Type: "error", Content: "Not allowed to read this room"})
+		return
+	}
+	c.reply(Message{Type: "who", Room: room, Users: hub.roster(room), Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// onlineHandler serves GET /rooms/{room}/members/online. The public room
+// needs no token.
+func onlineHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+
+	userID := ""
+	if room != publicRoom {
+		s, err := sessionFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = s.userID
+	}
+	if rl, err := roleOf(room, userID); err != nil || !rl.canRead() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"room": room, "users": hub.roster(room)})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	owner, u := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, u, "member")
+	oc := dial(t, room, owner)
+
+	// A user joins with their first tab and leaves with their last
+	tab1 := dial(t, room, u)
+	if m := oc.next("presence_join"); m.Username != u.name || m.Room != room {
+		t.Errorf("presence_join = %+v", m)
+	}
+	tab2 := dial(t, room, u)
+	oc.none("presence_join", 100*time.Millisecond)
+
+	tab2.send(Message{Type: "who", Room: room})
+	want := []string{owner.name, u.name}
+	slices.Sort(want)
+	if m := tab2.next("who"); !slices.Equal(m.Users, want) {
+		t.Errorf("who = %v, want %v", m.Users, want)
+	}
+	var online struct {
+		Users []string `json:"users"`
+	}
+	code, body := api(t, "GET", "/rooms/"+room+"/members/online", owner.token, nil)
+	if code != http.StatusOK || json.Unmarshal(body, &online) != nil || len(online.Users) != 2 {
+		t.Errorf("online: %d %s", code, body)
+	}
+
+	tab1.conn.Close()
+	oc.none("presence_leave", 200*time.Millisecond)
+	tab2.conn.Close()
+	if m := oc.next("presence_leave"); m.Username != u.name {
+		t.Errorf("presence_leave = %+v", m)
+	}
+
+	if code, _ := api(t, "GET", "/rooms/"+room+"/members/online", newUser(t).token, nil); code != http.StatusForbidden {
+		t.Errorf("outsider's roster: %d, want 403", code)
+	}
+}
+
+// announced returns the presence events h raised since the last call
+func announced(h *Hub) []string {
+	var events []string
+	for _, m := range h.pending {
+		events = append(events, m.Type+" "+m.Username)
+	}
+	h.pending = nil
+	return events
+}
+
+// A user connected through several nodes joins and leaves once
+func TestPresenceAcrossNodes(t *testing.T) {
+	h := newTestHub()
+	room := uniqueName("room")
+	c := testClient(h)
+	c.sess.Store(&session{userID: "1", username: "alice"})
+	sub := &subscription{client: c, room: room, live: true}
+
+	h.remotePresence("n2", room, "1", "alice", true)
+	h.markPresent(sub)
+	if got := announced(h); !slices.Equal(got, []string{"presence_join alice"}) {
+		t.Errorf("join on two nodes announced %v", got)
+	}
+
+	h.markAbsent(sub)
+	if got := announced(h); got != nil {
+		t.Errorf("leaving one node announced %v", got)
+	}
+	if got := h.roster(room); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("roster = %v, want alice", got)
+	}
+
+	// A restarted node has no clients yet
+	h.nodeStarted("n2")
+	if got := announced(h); !slices.Equal(got, []string{"presence_leave alice"}) {
+		t.Errorf("node restart announced %v", got)
+	}
+	if got := h.roster(room); len(got) != 0 {
+		t.Errorf("roster after restart = %v", got)
+	}
+}
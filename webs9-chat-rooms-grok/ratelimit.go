@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Rate limit scopes; each has its own token buckets
+const (
+	scopeUser = "user"
+	scopeIP   = "ip"
+	scopeRoom = "room"
+)
+
+// Window in which a connection's rejected frames count towards -rate-kick
+const strikeWindow = time.Minute
+
+// rateLimit lets Rate frames per second through with bursts of up to Burst.
+// A zero Rate means unlimited.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// parseRateLimit reads a limit written as "rate:burst", e.g. "2:10"
+func parseRateLimit(s string) (rateLimit, error) {
+	rate, burst, ok := strings.Cut(s, ":")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit %q is not rate:burst", s)
+	}
+	var l rateLimit
+	var err error
+	if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return rateLimit{}, fmt.Errorf("rate limit %q: %w", s, err)
+	}
+	if l.Burst, err = strconv.Atoi(burst); err != nil {
+		return rateLimit{}, fmt.Errorf("rate limit %q: %w", s, err)
+	}
+	return l, l.validate()
+}
+
+func (l rateLimit) validate() error {
+	if l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) || l.Burst < 0 || (l.Rate > 0 && l.Burst < 1) {
+		return fmt.Errorf("invalid rate limit %v:%d", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps token buckets per user, IP and room
+type rateLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]rateLimit // by scope
+	kickAfter int                  // rejected frames per strikeWindow before disconnecting, 0 never
+	buckets   map[string]*bucket   // by scope and key
+}
+
+var limiter = rateLimiter{
+	limits:  make(map[string]rateLimit),
+	buckets: make(map[string]*bucket),
+}
+
+// rateKey names one bucket
+type rateKey struct {
+	scope, key string
+}
+
+// refill tops up a bucket for the time passed since it was last used. The
+// caller must hold rl.mu.
+func (rl *rateLimiter) refill(k rateKey, l rateLimit, now time.Time) *bucket {
+	id := k.scope + "\x00" + k.key
+	b := rl.buckets[id]
+	if b == nil {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		rl.buckets[id] = b
+		return b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	return b
+}
+
+// take spends one token from every bucket in keys, or none of them if one is
+// empty. It then returns the scope that refused and how long until it
+// has a token again.
+func (rl *rateLimiter) take(keys ...rateKey) (string, time.Duration, bool) {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	buckets := make([]*bucket, 0, len(keys))
+	for _, k := range keys {
+		l := rl.limits[k.scope]
+		if l.Rate <= 0 {
+			continue
+		}
+		b := rl.refill(k, l, now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+			return k.scope, wait, false
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return "", 0, true
+}
+
+// sweep forgets buckets that have refilled completely, since a new bucket
+// starts out full anyway
+func (rl *rateLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		rl.mu.Lock()
+		for id, b := range rl.buckets {
+			scope, _, _ := strings.Cut(id, "\x00")
+			l := rl.limits[scope]
+			if l.Rate <= 0 || now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+				delete(rl.buckets, id)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// rateConfig is the admin view of the limits; nil fields are left unchanged
+// on update
+type rateConfig struct {
+	User      *rateLimit `json:"user,omitempty"`
+	IP        *rateLimit `json:"ip,omitempty"`
+	Room      *rateLimit `json:"room,omitempty"`
+	KickAfter *int       `json:"kick_after,omitempty"`
+}
+
+func (rl *rateLimiter) config() rateConfig {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	user, ip, room, kick := rl.limits[scopeUser], rl.limits[scopeIP], rl.limits[scopeRoom], rl.kickAfter
+	return rateConfig{User: &user, IP: &ip, Room: &room, KickAfter: &kick}
+}
+
+func (rl *rateLimiter) update(c rateConfig) error {
+	for _, l := range []*rateLimit{c.User, c.IP, c.Room} {
+		if l != nil {
+			if err := l.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if c.KickAfter != nil && *c.KickAfter < 0 {
+		return fmt.Errorf("invalid kick_after %d", *c.KickAfter)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for scope, l := range map[string]*rateLimit{scopeUser: c.User, scopeIP: c.IP, scopeRoom: c.Room} {
+		if l != nil {
+			rl.limits[scope] = *l
+		}
+	}
+	if c.KickAfter != nil {
+		rl.kickAfter = *c.KickAfter
+	}
+	return nil
+}
+
+// rateLimited reports whether readPump must drop msg, telling the client
+// when to retry. Frames that query or write the database or make the hub
+// send history are charged to the sender's IP and user buckets before any
+// check runs, so frames failing a check cost a token too.
+func (c *Client) rateLimited(msg Message) bool {
+	switch msg.Type {
+	case "message", "dm", "dm_read", "edit", "delete", "react", "unreact",
+		"subscribe", "unsubscribe", "resume", "subscribe_thread", "unsubscribe_thread",
+		"history", "who", "search", "invite", "remove",
+		"mute", "unmute", "kick", "ban", "unban":
+	default:
+		return false
+	}
+
+	keys := []rateKey{{scopeIP, c.ip}}
+	if s := c.sess.Load(); s != nil {
+		keys = append(keys, rateKey{scopeUser, s.userID})
+	}
+	return c.charge(msg, keys...)
+}
+
+// roomRateLimited charges a chat message that passed every check to its
+// room's bucket, so frames naming a room the sender can't post to don't use
+// it up
+func (c *Client) roomRateLimited(msg Message, room string) bool {
+	return c.charge(msg, rateKey{scopeRoom, room})
+}
+
+// charge takes a token from each bucket, or tells the client when to retry
+// and counts a strike towards -rate-kick
+func (c *Client) charge(msg Message, keys ...rateKey) bool {
+	scope, wait, ok := limiter.take(keys...)
+	if ok {
+		return false
+	}
+
+	c.reply(Message{
+		Type:        "rate_limited",
+		ClientMsgID: msg.ClientMsgID,
+		Code:        scope,
+		Content:     "Too many messages, slow down",
+		RetryAfter:  wait.Milliseconds() + 1,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	})
+
+	now := time.Now()
+	if now.Sub(c.strikesSince) > strikeWindow {
+		c.strikes, c.strikesSince = 0, now
+	}
+	c.strikes++
+	limiter.mu.Lock()
+	kickAfter := limiter.kickAfter
+	limiter.mu.Unlock()
+	if kickAfter > 0 && c.strikes >= kickAfter {
+		hub.disconnect <- disconnectRequest{client: c, closeFrame: websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")}
+		c.drain()
+	}
+	return true
+}
+
+// rateLimitsHandler serves GET and PUT /admin/rate-limits
+func rateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var c rateConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := limiter.update(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.config())
+}
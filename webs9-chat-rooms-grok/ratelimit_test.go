@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	cases := map[string]bool{
+		"2:10":  true,
+		"0:0":   true,
+		"0.5:1": true,
+		"2":     false,
+		"x:1":   false,
+		"1:x":   false,
+		"-1:1":  false,
+		"1:0":   false,
+		"NaN:1": false,
+		"Inf:1": false,
+	}
+	for s, ok := range cases {
+		if _, err := parseRateLimit(s); (err == nil) != ok {
+			t.Errorf("parseRateLimit(%q): err = %v", s, err)
+		}
+	}
+}
+
+func TestTakeAllOrNothing(t *testing.T) {
+	rl := rateLimiter{
+		limits:  map[string]rateLimit{scopeUser: {Rate: 0.001, Burst: 2}, scopeRoom: {Rate: 0.001, Burst: 1}},
+		buckets: make(map[string]*bucket),
+	}
+	user, room, ip := rateKey{scopeUser, "1"}, rateKey{scopeRoom, "r"}, rateKey{scopeIP, "a"}
+
+	if _, _, ok := rl.take(user, room, ip); !ok {
+		t.Fatal("first take refused")
+	}
+	scope, wait, ok := rl.take(user, room, ip)
+	if ok || scope != scopeRoom || wait <= 0 {
+		t.Errorf("take from an empty room bucket = %q, %v, %v", scope, wait, ok)
+	}
+	// The refused take left the user's second token, and unlimited scopes
+	// never refuse
+	if _, _, ok := rl.take(user, ip); !ok {
+		t.Error("user bucket charged by a refused take")
+	}
+	if scope, _, ok := rl.take(user); ok || scope != scopeUser {
+		t.Errorf("take from an empty user bucket = %q, %v", scope, ok)
+	}
+}
+
+// setRateLimits changes the limits through the admin endpoint for the rest of
+// the test, starting from full buckets
+func setRateLimits(t *testing.T, c rateConfig) {
+	t.Helper()
+	prev := limiter.config()
+	t.Cleanup(func() {
+		limiter.update(prev)
+		limiter.mu.Lock()
+		clear(limiter.buckets)
+		limiter.mu.Unlock()
+	})
+	limiter.mu.Lock()
+	clear(limiter.buckets)
+	limiter.mu.Unlock()
+	if code, body := api(t, "PUT", "/admin/rate-limits", adminUser(t).token, c); code != http.StatusOK {
+		t.Fatalf("set rate limits: %d %s", code, body)
+	}
+}
+
+func TestRateLimitsHandler(t *testing.T) {
+	admin := adminUser(t)
+	setRateLimits(t, rateConfig{})
+
+	kick := 3
+	code, body := api(t, "PUT", "/admin/rate-limits", admin.token, rateConfig{Room: &rateLimit{Rate: 2, Burst: 5}, KickAfter: &kick})
+	var got rateConfig
+	if code != http.StatusOK || json.Unmarshal(body, &got) != nil {
+		t.Fatalf("PUT: %d %s", code, body)
+	}
+	if *got.Room != (rateLimit{Rate: 2, Burst: 5}) || *got.KickAfter != 3 || *got.User != (rateLimit{}) {
+		t.Errorf("config = %s", body)
+	}
+
+	for _, c := range []any{rateConfig{User: &rateLimit{Rate: 1}}, map[string]int{"kick_after": -1}, "x"} {
+		if code, _ := api(t, "PUT", "/admin/rate-limits", admin.token, c); code != http.StatusBadRequest {
+			t.Errorf("PUT %+v: %d, want 400", c, code)
+		}
+	}
+	if code, _ := api(t, "GET", "/admin/rate-limits", newUser(t).token, nil); code != http.StatusForbidden {
+		t.Errorf("GET as a user: %d, want 403", code)
+	}
+}
+
+// Frames are charged to the user before any check, so ones that fail a
+// check still cost a token; the room is only charged for messages that
+// passed every check.
+func TestRateLimitOrdering(t *testing.T) {
+	owner, member, outsider := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, member, "member")
+	oc, mc, xc := dial(t, room, owner), dial(t, room, member), dialRaw(t, room, outsider)
+	setRateLimits(t, rateConfig{
+		User: &rateLimit{Rate: 0.001, Burst: 3},
+		Room: &rateLimit{Rate: 0.001, Burst: 1},
+	})
+
+	// Failing frames use up the outsider's user bucket but not the room's
+	xc.send(Message{Type: "edit", ID: 1 << 40, Content: "x"})
+	xc.next("error")
+	for range 2 {
+		if m := xc.chat("not allowed"); m.Type != "nack" || m.Code != "forbidden" {
+			t.Fatalf("outsider's message: %+v", m)
+		}
+	}
+	m := xc.chat("not allowed")
+	if m.Type != "rate_limited" || m.Code != scopeUser || m.RetryAfter <= 0 {
+		t.Errorf("fourth frame: %+v, want rate_limited by user", m)
+	}
+
+	if m := mc.chat("first"); m.Type != "ack" {
+		t.Errorf("first message in the room: %+v, want an ack", m)
+	}
+	if m := oc.chat("second"); m.Type != "rate_limited" || m.Code != scopeRoom {
+		t.Errorf("second message in the room: %+v, want rate_limited by room", m)
+	}
+}
+
+func TestRateLimitIP(t *testing.T) {
+	c := dial(t, publicRoom, testUser{})
+	setRateLimits(t, rateConfig{IP: &rateLimit{Rate: 0.001, Burst: 1}})
+
+	if m := c.chat("anonymous"); m.Type != "ack" {
+		t.Fatalf("first message: %+v", m)
+	}
+	if m := c.chat("anonymous"); m.Type != "rate_limited" || m.Code != scopeIP {
+		t.Errorf("second message: %+v, want rate_limited by ip", m)
+	}
+}
+
+func TestRateLimitKick(t *testing.T) {
+	c := dial(t, publicRoom, newUser(t))
+	kick := 2
+	setRateLimits(t, rateConfig{User: &rateLimit{Rate: 0.001, Burst: 1}, KickAfter: &kick})
+
+	c.chat("allowed")
+	if m := c.chat("strike one"); m.Type != "rate_limited" {
+		t.Fatalf("second message: %+v", m)
+	}
+	c.send(Message{Type: "message", Room: publicRoom, Content: "strike two"})
+	if ce := c.closed(); ce == nil || ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("closed with %v, want %d", ce, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	c := dial(t, publicRoom, newUser(t))
+	setRateLimits(t, rateConfig{User: &rateLimit{Rate: 20, Burst: 1}})
+
+	c.chat("first")
+	m := c.chat("too soon")
+	if m.Type != "rate_limited" {
+		t.Fatalf("second message: %+v", m)
+	}
+	time.Sleep(time.Duration(m.RetryAfter) * time.Millisecond)
+	if m := c.chat("after waiting"); m.Type != "ack" {
+		t.Errorf("message after retry_after: %+v, want an ack", m)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"webs9-chat-db/store"
+)
+
+const maxEmojiLen = 32
+
+var errInvalidEmoji = errors.New("invalid emoji")
+
+// reactionCount is how many users reacted to a message with one emoji
+type reactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLen {
+		return false
+	}
+	return !strings.ContainsFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+// setReaction adds or removes actor's emoji reaction and returns the message
+// with its updated counts
+func setReaction(id int64, actor *session, emoji string, add bool) (Message, error) {
+	if !validEmoji(emoji) {
+		return Message{}, errInvalidEmoji
+	}
+
+	sm, err := messageStore.Get(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return Message{}, errNoSuchMessage
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	if sm.Deleted {
+		return Message{}, errMessageDeleted
+	}
+	m := changedMessage(sm)
+	if r, err := roleOf(m.Room, actor.userID); err != nil {
+		return Message{}, err
+	} else if !r.canWrite() {
+		return Message{}, errForbidden
+	}
+
+	if add {
+		_, err = db.Exec("INSERT OR IGNORE INTO reactions (message_id, user_id, emoji) VALUES (?, ?, ?)", id, actor.userID, emoji)
+	} else {
+		_, err = db.Exec("DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?", id, actor.userID, emoji)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	counts, err := loadReactions([]int64{id})
+	if err != nil {
+		return Message{}, err
+	}
+	m.Type = "reaction_updated"
+	m.Username = actor.username
+	m.Emoji = emoji
+	m.Reactions = counts[id]
+	if m.Reactions == nil {
+		m.Reactions = []reactionCount{}
+	}
+	m.Timestamp = time.Now().Format(time.RFC3339)
+	return m, nil
+}
+
+// loadReactions returns the reaction counts of the given messages, emojis in
+// the order they were first used
+func loadReactions(ids []int64) (map[int64][]reactionCount, error) {
+	counts := make(map[int64][]reactionCount)
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(`
+		SELECT message_id, emoji, COUNT(*) FROM reactions
+		WHERE message_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		GROUP BY message_id, emoji ORDER BY MIN(rowid)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var rc reactionCount
+		if err := rows.Scan(&id, &rc.Emoji, &rc.Count); err != nil {
+			return nil, err
+		}
+		counts[id] = append(counts[id], rc)
+	}
+	return counts, rows.Err()
+}
+
+// attachReactions fills in the reaction summaries of history messages
+func attachReactions(msgs []Message) error {
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	counts, err := loadReactions(ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Reactions = counts[msgs[i].ID]
+	}
+	return nil
+}
+
+// react handles websocket "react" and "unreact" and tells the room
+func (c *Client) react(id int64, emoji string, add bool) {
+	s := c.sess.Load()
+	if s == nil {
+		c.reply(Message{Type: "error", Content: "Auth required"})
+		return
+	}
+
+	m, err := setReaction(id, s, emoji, add)
+	if errors.Is(err, errInvalidEmoji) {
+		c.reply(Message{Type: "error", ID: id, Content: "Invalid emoji"})
+		return
+	}
+	if err != nil {
+		c.reply(Message{Type: "error", ID: id, Content: changeErrorText(err)})
+		return
+	}
+	hub.notify <- m
+}
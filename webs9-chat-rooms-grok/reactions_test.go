@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	cases := map[string]bool{
+		"👍":                              true,
+		"👩‍👩‍👧":                          true,
+		":party:":                        true,
+		"":                               false,
+		"a b":                            false,
+		"x\n":                            false,
+		strings.Repeat("👍", 9):           false,
+		strings.Repeat("x", maxEmojiLen): true,
+	}
+	for emoji, want := range cases {
+		if got := validEmoji(emoji); got != want {
+			t.Errorf("validEmoji(%q) = %v, want %v", emoji, got, want)
+		}
+	}
+}
+
+func TestReactions(t *testing.T) {
+	owner, member, reader := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, member, "member")
+	addMember(t, room, owner, reader, "read-only")
+	oc, mc, rc := dial(t, room, owner), dial(t, room, member), dial(t, room, reader)
+	id := oc.chat("react to me").ID
+
+	counts := func(m Message) string {
+		t.Helper()
+		if m.ID != id {
+			t.Errorf("reaction_updated for %d, want %d", m.ID, id)
+		}
+		return fmt.Sprint(m.Reactions)
+	}
+
+	oc.send(Message{Type: "react", ID: id, Emoji: "👍"})
+	rc.next("reaction_updated")
+	mc.send(Message{Type: "react", ID: id, Emoji: "❤️"})
+	rc.next("reaction_updated")
+	mc.send(Message{Type: "react", ID: id, Emoji: "👍"})
+	m := rc.next("reaction_updated")
+	if got, want := counts(m), "[{👍 2} {❤️ 1}]"; got != want || m.Username != member.name || m.Emoji != "👍" {
+		t.Errorf("reaction_updated = %+v, want counts %s", m, want)
+	}
+
+	// Reacting twice counts once
+	mc.send(Message{Type: "react", ID: id, Emoji: "👍"})
+	if got := counts(rc.next("reaction_updated")); got != "[{👍 2} {❤️ 1}]" {
+		t.Errorf("counts after a repeated reaction: %s", got)
+	}
+	mc.send(Message{Type: "unreact", ID: id, Emoji: "❤️"})
+	if got := counts(rc.next("reaction_updated")); got != "[{👍 2}]" {
+		t.Errorf("counts after unreact: %s", got)
+	}
+
+	msgs, err := getMessagesBefore(room, 0, 1)
+	if err != nil || fmt.Sprint(msgs[0].Reactions) != "[{👍 2}]" {
+		t.Errorf("history reactions = %v, %v", msgs[0].Reactions, err)
+	}
+
+	rc.send(Message{Type: "react", ID: id, Emoji: "👍"})
+	if m := rc.next("error"); m.Content != errForbidden.Error() {
+		t.Errorf("read-only member's reaction: %+v", m)
+	}
+	mc.send(Message{Type: "react", ID: id, Emoji: "no spaces"})
+	if m := mc.next("error"); m.Content != "Invalid emoji" {
+		t.Errorf("invalid emoji: %+v", m)
+	}
+
+	// Deleting a message drops its reactions
+	oc.send(Message{Type: "delete", ID: id})
+	oc.next("message_deleted")
+	mc.send(Message{Type: "react", ID: id, Emoji: "👍"})
+	if m := mc.next("error"); m.Content != errMessageDeleted.Error() {
+		t.Errorf("reaction to a deleted message: %+v", m)
+	}
+	if counts, _ := loadReactions([]int64{id}); len(counts[id]) != 0 {
+		t.Errorf("deleted message kept reactions %v", counts[id])
+	}
+}
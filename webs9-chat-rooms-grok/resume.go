@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Largest gap replayed on resume; beyond it the client must resync from history
+const maxReplay = 500
+
+type resumeRequest struct {
+	client *Client
+	room   string
+	since  int64
+}
+
+// deliveredSeq returns the last seq of room that was stored and delivered,
+// loading it on first use. Later seqs may be waiting for the writer. publish
+// loads it before queueing a room's first message, so the store's last seq
+// never includes a message whose result the hub has yet to deliver.
+func (h *Hub) deliveredSeq(room string) int64 {
+	if seq, ok := h.delivered[room]; ok {
+		return seq
+	}
+
+	seq, err := messageStore.LastSeq(room)
+	if err != nil {
+		slog.Error("DB seq error", "err", err)
+	}
+	h.delivered[room] = seq
+	return seq
+}
+
+// goLive sends the client what it missed in a room, either the replay it
+// asked for or the recent history, and switches the subscription to live
+// delivery. Both happen on the hub goroutine, so no message can fall between
+// the two.
+func (h *Hub) goLive(sub *subscription) {
+	sub.live = true
+	sub.liveAfter = h.deliveredSeq(sub.room)
+
+	if sub.since < 0 {
+		for _, m := range getRecentMessages(sub.room, 20) {
+			if m.Seq > sub.liveAfter {
+				// Stored but not delivered yet; it comes live
+				break
+			}
+			h.sendTo(sub.client, m)
+		}
+		return
+	}
+	h.replay(sub, sub.since)
+}
+
+// handleResume replays what a live subscription missed before it started
+// receiving live messages; subscriptions that can't read the room yet keep
+// since for goLive
+func (h *Hub) handleResume(req resumeRequest) {
+	sub := h.subscription(req.client, req.room)
+	if sub == nil || req.since < 0 {
+		return
+	}
+
+	if !sub.live {
+		sub.since = req.since
+		return
+	}
+	h.replay(sub, req.since)
+}
+
+// replay sends the messages after since up to where live delivery started as
+// a single frame, or asks the client to resync if the gap is too large
+func (h *Hub) replay(sub *subscription, since int64) {
+	client := sub.client
+	upTo := sub.liveAfter
+	if since > upTo {
+		since = upTo
+	}
+	now := time.Now().Format(time.RFC3339)
+
+	if upTo-since > maxReplay {
+		h.sendTo(client, Message{Type: "resync_required", Room: sub.room, Seq: upTo, Content: "Too many missed messages, reload history", Timestamp: now})
+		return
+	}
+
+	msgs, err := getMessagesInSeqRange(sub.room, since, upTo)
+	if err != nil {
+		slog.Error("DB replay error", "err", err)
+		h.sendTo(client, Message{Type: "resync_required", Room: sub.room, Seq: upTo, Content: "Could not replay, reload history", Timestamp: now})
+		return
+	}
+	h.sendTo(client, Message{Type: "replay", Room: sub.room, Since: since, Seq: upTo, Messages: msgs, Timestamp: now})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+// newTestHub returns a hub that isn't running, for tests that drive its
+// steps one at a time. Its writer shares the test store but has no run loop
+// either.
+func newTestHub() *Hub {
+	return &Hub{
+		rooms:       make(map[string]map[*Client]*subscription),
+		clients:     make(map[*Client]bool),
+		users:       make(map[string]map[*Client]bool),
+		delivered:   make(map[string]int64),
+		inflight:    make(map[string]bool),
+		presence:    make(map[string]map[string]*presenceEntry),
+		typingUsers: make(map[string]map[string]*typingState),
+		slow:        make(map[*Client]bool),
+		writer:      newMessageWriter(messageStore, 1, 0, 16),
+	}
+}
+
+// testClient adds a client with no connection to h
+func testClient(h *Hub) *Client {
+	c := &Client{send: make(chan []byte, 64), subs: make(map[string]*subscription), log: slog.Default()}
+	h.clients[c] = true
+	return c
+}
+
+// sent returns the frames queued for c
+func sent(t *testing.T, c *Client) []Message {
+	t.Helper()
+	var frames []Message
+	for {
+		select {
+		case data := <-c.send:
+			var m Message
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, m)
+		default:
+			return frames
+		}
+	}
+}
+
+// A client going live while a room's first message is being written must get
+// it once: live, not also in its replay or history.
+func TestFirstMessageDeliveredOnce(t *testing.T) {
+	for _, since := range []int64{0, -1} {
+		h := newTestHub()
+		room := uniqueName("room")
+		sender := testClient(h)
+		h.publish(Message{Type: "message", Room: room, Content: "first", from: sender})
+		results := h.writer.write([]Message{<-h.writer.queue})
+
+		c := testClient(h)
+		sub := &subscription{client: c, room: room, since: since, uncount: func() {}}
+		c.subs[room] = sub
+		h.rooms[room] = map[*Client]*subscription{c: sub}
+		h.goLive(sub)
+		h.persisted(results)
+
+		var got []int64
+		for _, m := range sent(t, c) {
+			if m.Type == "message" {
+				got = append(got, m.Seq)
+			}
+			for _, r := range m.Messages {
+				got = append(got, r.Seq)
+			}
+		}
+		if want := []int64{results[0].message.Seq}; !slices.Equal(got, want) {
+			t.Errorf("since %d: delivered seqs %v, want %v", since, got, want)
+		}
+	}
+}
+
+func TestResumeReplay(t *testing.T) {
+	owner := newUser(t)
+	room := newRoom(t, owner)
+	c := dial(t, room, owner)
+	var acks []Message
+	for _, content := range []string{"one", "two", "three"} {
+		acks = append(acks, c.chat(content))
+	}
+
+	// A reconnecting client replays what it missed since its last seq
+	c2 := dialRaw(t, room, owner)
+	c2.send(Message{Type: "resume", Room: room, Since: acks[0].Seq})
+	m := c2.next("replay")
+	if len(m.Messages) != 2 || m.Messages[0].Content != "two" || m.Messages[1].Content != "three" {
+		t.Errorf("replay = %+v, want two and three", m.Messages)
+	}
+	if m.Since != acks[0].Seq || m.Seq != acks[2].Seq {
+		t.Errorf("replay covers (%d, %d], want (%d, %d]", m.Since, m.Seq, acks[0].Seq, acks[2].Seq)
+	}
+
+	// Subscribing with since replays instead of sending recent history
+	other := newRoom(t, owner)
+	oc := dial(t, other, owner)
+	first := oc.chat("first")
+	oc.chat("second")
+	c2.send(Message{Type: "subscribe", Room: other, Since: first.Seq})
+	c2.next("join")
+	if m := c2.next("replay"); m.Room != other || len(m.Messages) != 1 || m.Messages[0].Content != "second" {
+		t.Errorf("subscribe replay = %+v, want second", m)
+	}
+
+	// Live messages follow the replay
+	c.chat("four")
+	c2.message("four")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"webs9-chat-db/store"
+)
+
+const (
+	// Messages deleted per statement, and the pause between statements so
+	// the writer gets the database in between
+	purgeBatch = 500
+	purgePause = 100 * time.Millisecond
+
+	// Longest max_age; longer ones are cut to this
+	maxRetentionAge = 100 * 365 * 24 * time.Hour
+)
+
+// retentionPolicy limits which messages of a room are kept. Zero limits
+// mean no limit; KeepForever exempts a room from the server default.
+type retentionPolicy struct {
+	MaxAge      int64 `json:"max_age"` // seconds
+	MaxCount    int   `json:"max_count"`
+	KeepForever bool  `json:"keep_forever,omitempty"`
+}
+
+// validate checks a policy from a request and cuts MaxAge to
+// maxRetentionAge, so converting it can't overflow
+func (p *retentionPolicy) validate() error {
+	if p.MaxAge < 0 || p.MaxCount < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if p.KeepForever && (p.MaxAge != 0 || p.MaxCount != 0) {
+		return errors.New("keep_forever can't be combined with limits")
+	}
+	p.MaxAge = min(p.MaxAge, int64(maxRetentionAge/time.Second))
+	return nil
+}
+
+// age returns MaxAge as a duration, cut like validate does for policies
+// stored before it did
+func (p retentionPolicy) age() time.Duration {
+	return time.Duration(min(p.MaxAge, int64(maxRetentionAge/time.Second))) * time.Second
+}
+
+// Room whose row in room_retention is the server default, overriding the
+// -retention flags
+const defaultRetentionRoom = ""
+
+// loadRetention returns the policy set for room, if any
+func loadRetention(room string) (retentionPolicy, bool, error) {
+	var p retentionPolicy
+	err := db.QueryRow("SELECT max_age, max_count, keep_forever FROM room_retention WHERE room = ?", room).
+		Scan(&p.MaxAge, &p.MaxCount, &p.KeepForever)
+	if errors.Is(err, sql.ErrNoRows) {
+		return retentionPolicy{}, false, nil
+	}
+	return p, err == nil, err
+}
+
+// defaultRetention returns the policy of rooms without their own
+func defaultRetention() (retentionPolicy, error) {
+	p, ok, err := loadRetention(defaultRetentionRoom)
+	if err != nil || ok {
+		return p, err
+	}
+	return retentionPolicy{MaxAge: int64(retentionAge.Seconds()), MaxCount: *retentionCount}, nil
+}
+
+// effectiveRetention returns the policy that applies to room
+func effectiveRetention(room string) (retentionPolicy, error) {
+	p, ok, err := loadRetention(room)
+	if err != nil || ok {
+		return p, err
+	}
+	return defaultRetention()
+}
+
+func saveRetention(room string, p retentionPolicy, actor *session) error {
+	_, err := db.Exec(`
+		INSERT INTO room_retention (room, max_age, max_count, keep_forever, updated_by, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (room) DO UPDATE SET max_age = excluded.max_age, max_count = excluded.max_count,
+			keep_forever = excluded.keep_forever, updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		room, p.MaxAge, p.MaxCount, p.KeepForever, actor.userID, time.Now().UTC().Truncate(time.Second))
+	return err
+}
+
+// roomRetentions returns the rooms with a policy of their own
+func roomRetentions() (map[string]retentionPolicy, error) {
+	rows, err := db.Query("SELECT room, max_age, max_count, keep_forever FROM room_retention WHERE room != ?", defaultRetentionRoom)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]retentionPolicy)
+	for rows.Next() {
+		var room string
+		var p retentionPolicy
+		if err := rows.Scan(&room, &p.MaxAge, &p.MaxCount, &p.KeepForever); err != nil {
+			return nil, err
+		}
+		rooms[room] = p
+	}
+	return rooms, rows.Err()
+}
+
+// janitor deletes expired messages and keeps the database file in shape. It
+// runs on its own goroutine and only talks to the stores, never the hub.
+func janitor() {
+	var purge, checkpoint, vacuum <-chan time.Time
+	if *purgeInterval > 0 {
+		t := time.NewTicker(*purgeInterval)
+		defer t.Stop()
+		purge = t.C
+	}
+	if *checkpointInterval > 0 {
+		t := time.NewTicker(*checkpointInterval)
+		defer t.Stop()
+		checkpoint = t.C
+	}
+	if *vacuumInterval > 0 {
+		t := time.NewTicker(*vacuumInterval)
+		defer t.Stop()
+		vacuum = t.C
+	}
+
+	for {
+		select {
+		case <-purge:
+			purgeExpired()
+		case <-checkpoint:
+			if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+				slog.Error("DB checkpoint error", "err", err)
+			}
+		case <-vacuum:
+			start := time.Now()
+			if _, err := db.Exec("VACUUM"); err != nil {
+				slog.Error("DB vacuum error", "err", err)
+				continue
+			}
+			slog.Info("Vacuumed database", "took", time.Since(start).Round(time.Millisecond).String())
+		}
+	}
+}
+
+// purgeExpired applies the retention policy of every room with messages
+func purgeExpired() {
+	purger, ok := messageStore.(store.Purger)
+	if !ok {
+		return
+	}
+	rooms, err := purger.Rooms()
+	if err != nil {
+		slog.Error("DB purge error", "err", err)
+		return
+	}
+
+	total := 0
+	defer func() {
+		if c, ok := messageStore.(store.Compacter); ok && total > 0 {
+			if err := c.Compact(); err != nil {
+				slog.Error("Compacting message store", "err", err)
+			}
+		}
+	}()
+	for _, room := range rooms {
+		p, err := effectiveRetention(room)
+		if err != nil {
+			slog.Error("DB retention error", "err", err)
+			return
+		}
+		if p.KeepForever {
+			continue
+		}
+
+		purged := 0
+		if p.MaxCount > 0 {
+			purged += purgeRoom(purger, room, time.Time{}, p.MaxCount)
+		}
+		if p.MaxAge > 0 {
+			// The newest message stays so the room's seqs keep counting
+			purged += purgeRoom(purger, room, time.Now().Add(-p.age()), 1)
+		}
+		total += purged
+		if purged > 0 {
+			slog.Info("Purged expired messages", "room", room, "count", purged)
+		}
+	}
+}
+
+// purgeRoom deletes messages in batches until none match, along with their
+// edit history and reactions, and returns how many it deleted
+func purgeRoom(purger store.Purger, room string, before time.Time, keep int) int {
+	total := 0
+	for {
+		ids, err := purger.Purge(room, before, keep, purgeBatch)
+		if err != nil {
+			slog.Error("DB purge error", "err", err)
+			return total
+		}
+		if len(ids) > 0 {
+			if err := deleteMessageExtras(ids); err != nil {
+				slog.Error("DB purge error", "err", err)
+			}
+		}
+		total += len(ids)
+		if len(ids) < purgeBatch {
+			return total
+		}
+		time.Sleep(purgePause)
+	}
+}
+
+// deleteMessageExtras removes the edit history and reactions of purged
+// messages
+func deleteMessageExtras(ids []int64) error {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id IN "+in, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM reactions WHERE message_id IN "+in, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retentionHandler serves GET and PUT /admin/retention, the server default
+// along with the rooms that have their own policy
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var p retentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveRetention(defaultRetentionRoom, p, actor); err != nil {
+			slog.Error("DB retention error", "err", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Default retention set", "by", actor.username, "policy", p)
+	}
+
+	def, err := defaultRetention()
+	var rooms map[string]retentionPolicy
+	if err == nil {
+		rooms, err = roomRetentions()
+	}
+	if err != nil {
+		slog.Error("DB retention error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"default": def, "rooms": rooms})
+}
+
+// roomRetentionHandler serves GET, PUT and DELETE /admin/retention/{room}.
+// DELETE puts the room back on the server default.
+func roomRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	room := r.PathValue("room")
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var p retentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = saveRetention(room, p, actor)
+		if err == nil {
+			slog.Info("Room retention set", "room", room, "by", actor.username, "policy", p)
+		}
+	case http.MethodDelete:
+		_, err = db.Exec("DELETE FROM room_retention WHERE room = ?", room)
+		if err == nil {
+			slog.Info("Room retention reset to default", "room", room, "by", actor.username)
+		}
+	}
+
+	var p retentionPolicy
+	var own bool
+	if err == nil {
+		if p, own, err = loadRetention(room); err == nil && !own {
+			p, err = defaultRetention()
+		}
+	}
+	if err != nil {
+		slog.Error("DB retention error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"room": room, "policy": p, "default": !own})
+}
+
+// retentionSummary describes the default policy for the startup log
+func retentionSummary(p retentionPolicy) string {
+	switch {
+	case p.KeepForever || p.MaxAge == 0 && p.MaxCount == 0:
+		return "messages kept forever"
+	case p.MaxCount == 0:
+		return fmt.Sprintf("messages kept for %s", p.age())
+	case p.MaxAge == 0:
+		return fmt.Sprintf("last %d messages kept per room", p.MaxCount)
+	}
+	return fmt.Sprintf("messages kept for %s, at most %d per room", p.age(), p.MaxCount)
+}
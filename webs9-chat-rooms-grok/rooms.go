@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Everyone, signed in or not, may read and post in the public room
+const publicRoom = "public"
+
+// Application close code sent when a client loses access to its room
+const closeRoomForbidden = 4003
+
+type role int
+
+const (
+	roleNone role = iota
+	roleReadOnly
+	roleMember
+	roleModerator
+	roleOwner
+)
+
+var roleNames = map[role]string{
+	roleReadOnly:  "read-only",
+	roleMember:    "member",
+	roleModerator: "moderator",
+	roleOwner:     "owner",
+}
+
+func (r role) String() string { return roleNames[r] }
+
+func (r role) canRead() bool  { return r >= roleReadOnly }
+func (r role) canWrite() bool { return r >= roleMember }
+
+func parseRole(s string) (role, bool) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, true
+		}
+	}
+	return roleNone, false
+}
+
+var (
+	roomPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+	errRoomExists  = errors.New("room already exists")
+	errNoSuchUser  = errors.New("no such user")
+	errForbidden   = errors.New("forbidden")
+	errInvalidRole = errors.New("invalid role")
+)
+
+func createRoom(name string, owner *session) error {
+	if name == publicRoom {
+		return errRoomExists
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO rooms (name, owner_id) VALUES (?, ?)", name, owner.userID); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return errRoomExists
+		}
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO room_members (room, user_id, role) VALUES (?, ?, ?)", name, owner.userID, roleOwner.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// roleOf returns the role of userID in room, lowered by any mute or ban.
+// Unauthenticated clients pass an empty userID.
+func roleOf(room, userID string) (role, error) {
+	r, err := memberRole(room, userID)
+	if err != nil {
+		return roleNone, err
+	}
+	return applySanctions(r, room, userID, "")
+}
+
+// memberRole is roleOf before sanctions
+func memberRole(room, userID string) (role, error) {
+	if room == publicRoom {
+		return roleMember, nil
+	}
+	if userID == "" {
+		return roleNone, nil
+	}
+
+	var name string
+	err := db.QueryRow("SELECT role FROM room_members WHERE room = ? AND user_id = ?", room, userID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return roleNone, nil
+	}
+	if err != nil {
+		return roleNone, err
+	}
+	r, _ := parseRole(name)
+	return r, nil
+}
+
+// clientRole is roleOf for a connected client, also applying sanctions on
+// its IP address and treating lookup errors as no access. Moderators and
+// admins sharing an address with a banned user keep their access.
+func clientRole(c *Client, room string) role {
+	s := c.sess.Load()
+	userID := ""
+	if s != nil {
+		userID = s.userID
+	}
+	r, err := memberRole(room, userID)
+	if err == nil {
+		ip := c.ip
+		if r >= roleModerator || isAdmin(s) {
+			ip = ""
+		}
+		r, err = applySanctions(r, room, userID, ip)
+	}
+	if err != nil {
+		slog.Error("DB role lookup error", "err", err)
+		return roleNone
+	}
+	return r
+}
+
+func lookupUserID(username string) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errNoSuchUser
+	}
+	return id, err
+}
+
+// setMember adds username to room or changes its role. Only the owner manages
+// membership and ownership can't be granted or taken away this way.
+func setMember(room string, actor *session, username, roleName string) error {
+	r, ok := parseRole(roleName)
+	if !ok || r == roleOwner {
+		return errInvalidRole
+	}
+
+	if room == publicRoom {
+		return errForbidden
+	}
+	actorRole, err := roleOf(room, actor.userID)
+	if err != nil {
+		return err
+	}
+	if actorRole != roleOwner {
+		return errForbidden
+	}
+
+	userID, err := lookupUserID(username)
+	if err != nil {
+		return err
+	}
+	if userID == actor.userID {
+		return errForbidden
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO room_members (room, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT (room, user_id) DO UPDATE SET role = excluded.role`, room, userID, r.String())
+	if err != nil {
+		return err
+	}
+
+	hub.memberChanged <- memberChange{room: room, userID: userID}
+	return nil
+}
+
+// removeMember takes username out of room. Owners remove anyone but
+// themselves; everyone else may only leave.
+func removeMember(room string, actor *session, username string) error {
+	if room == publicRoom {
+		return errForbidden
+	}
+
+	userID, err := lookupUserID(username)
+	if err != nil {
+		return err
+	}
+	actorRole, err := roleOf(room, actor.userID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case userID == actor.userID && actorRole == roleOwner:
+		return errForbidden
+	case userID != actor.userID && actorRole != roleOwner:
+		return errForbidden
+	}
+
+	if _, err := db.Exec("DELETE FROM room_members WHERE room = ? AND user_id = ?", room, userID); err != nil {
+		return err
+	}
+
+	hub.memberChanged <- memberChange{room: room, userID: userID}
+	return nil
+}
+
+type roomMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func listMembers(room string) ([]roomMember, error) {
+	rows, err := db.Query(`
+		SELECT u.username, m.role FROM room_members m JOIN users u ON u.id = m.user_id
+		WHERE m.room = ? ORDER BY u.username`, room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []roomMember{}
+	for rows.Next() {
+		var m roomMember
+		if err := rows.Scan(&m.Username, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// memberErrorText is the error shown to websocket clients
+func memberErrorText(err error) string {
+	switch {
+	case errors.Is(err, errForbidden), errors.Is(err, errNoSuchUser), errors.Is(err, errRoomExists):
+		return err.Error()
+	case errors.Is(err, errInvalidRole):
+		return "Role must be moderator, member or read-only"
+	default:
+		slog.Error("Room error", "err", err)
+		return "Internal error"
+	}
+}
+
+// memberError maps membership errors to HTTP statuses
+func memberError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, errNoSuchUser):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidRole):
+		http.Error(w, "Role must be moderator, member or read-only", http.StatusBadRequest)
+	case errors.Is(err, errRoomExists):
+		http.Error(w, "Room already exists", http.StatusConflict)
+	default:
+		slog.Error("Room error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+func createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !roomPattern.MatchString(req.Name) {
+		http.Error(w, "Room name must be 1-64 letters, digits, '_' or '-'", http.StatusBadRequest)
+		return
+	}
+
+	if err := createRoom(req.Name, s); err != nil {
+		memberError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"name": req.Name, "owner": s.username})
+}
+
+func listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	room := r.PathValue("room")
+	if rl, err := roleOf(room, s.userID); err != nil || !rl.canRead() || room == publicRoom {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	members, err := listMembers(room)
+	if err != nil {
+		memberError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func setMemberHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := setMember(r.PathValue("room"), s, r.PathValue("username"), req.Role); err != nil {
+		memberError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := removeMember(r.PathValue("room"), s, r.PathValue("username")); err != nil {
+		memberError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateRoom(t *testing.T) {
+	u := newUser(t)
+	name := uniqueName("room")
+	cases := []struct {
+		token, name string
+		want        int
+	}{
+		{u.token, name, http.StatusCreated},
+		{u.token, name, http.StatusConflict},
+		{u.token, publicRoom, http.StatusConflict},
+		{u.token, "bad room", http.StatusBadRequest},
+		{"", uniqueName("room"), http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if code, body := api(t, "POST", "/rooms", c.token, map[string]string{"name": c.name}); code != c.want {
+			t.Errorf("create %q: %d %s, want %d", c.name, code, body, c.want)
+		}
+	}
+	if r, err := roleOf(name, mustUserID(t, u.name)); err != nil || r != roleOwner {
+		t.Errorf("creator's role = %v, %v, want owner", r, err)
+	}
+}
+
+func mustUserID(t *testing.T, username string) string {
+	t.Helper()
+	id, err := lookupUserID(username)
+	if err != nil {
+		t.Fatalf("user %s: %v", username, err)
+	}
+	return id
+}
+
+func TestRoomAccess(t *testing.T) {
+	owner, u := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	oc := dial(t, room, owner)
+
+	// Outsiders stay subscribed but neither read nor post
+	c := dialRaw(t, room, u)
+	oc.chat("before the invite")
+	c.none("message", 200*time.Millisecond)
+	if m := c.chat("hello"); m.Type != "nack" || m.Code != "forbidden" {
+		t.Errorf("outsider's message: %+v, want a forbidden nack", m)
+	}
+	if code, _ := api(t, "GET", "/rooms/"+room+"/messages", u.token, nil); code != http.StatusForbidden {
+		t.Errorf("outsider's history: %d, want 403", code)
+	}
+
+	// Read-only members read live but can't post
+	addMember(t, room, owner, u, "read-only")
+	if m := c.next("role_changed"); m.Role != "read-only" {
+		t.Errorf("role_changed to %q, want read-only", m.Role)
+	}
+	c.sync(room)
+	if m := c.chat("hello"); m.Type != "nack" || m.Code != "forbidden" {
+		t.Errorf("read-only member's message: %+v, want a forbidden nack", m)
+	}
+	oc.chat("from the owner")
+	c.message("from the owner")
+
+	addMember(t, room, owner, u, "member")
+	c.next("role_changed")
+	if m := c.chat("now I can"); m.Type != "ack" {
+		t.Errorf("member's message: %+v, want an ack", m)
+	}
+	if m := oc.message("now I can"); m.Username != u.name {
+		t.Errorf("owner got %+v", m)
+	}
+
+	var members []roomMember
+	code, body := api(t, "GET", "/rooms/"+room+"/members", u.token, nil)
+	if code != http.StatusOK || json.Unmarshal(body, &members) != nil || len(members) != 2 {
+		t.Errorf("members: %d %s", code, body)
+	}
+
+	// Removal closes a connection that has no other room
+	if code, _ := api(t, "DELETE", "/rooms/"+room+"/members/"+u.name, owner.token, nil); code != http.StatusNoContent {
+		t.Fatalf("remove: %d", code)
+	}
+	if ce := c.closed(); ce == nil || ce.Code != closeRoomForbidden {
+		t.Errorf("removed member closed with %v, want %d", ce, closeRoomForbidden)
+	}
+}
+
+func TestRoomMembership(t *testing.T) {
+	owner, mod, u := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, mod, "moderator")
+	addMember(t, room, owner, u, "member")
+
+	path := "/rooms/" + room + "/members/"
+	cases := []struct {
+		name         string
+		method, user string
+		actor        testUser
+		role         string
+		want         int
+	}{
+		{"moderator sets a role", "PUT", u.name, mod, "read-only", http.StatusForbidden},
+		{"invalid role", "PUT", u.name, owner, "admin", http.StatusBadRequest},
+		{"owner role", "PUT", u.name, owner, "owner", http.StatusBadRequest},
+		{"unknown user", "PUT", uniqueName("nobody"), owner, "member", http.StatusNotFound},
+		{"owner changes own role", "PUT", owner.name, owner, "member", http.StatusForbidden},
+		{"member removes another", "DELETE", mod.name, u, "", http.StatusForbidden},
+		{"owner leaves", "DELETE", owner.name, owner, "", http.StatusForbidden},
+		{"member leaves", "DELETE", u.name, u, "", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		var body any
+		if c.method == "PUT" {
+			body = map[string]string{"role": c.role}
+		}
+		if code, resp := api(t, c.method, path+c.user, c.actor.token, body); code != c.want {
+			t.Errorf("%s: %d %s, want %d", c.name, code, resp, c.want)
+		}
+	}
+
+	if code, _ := api(t, "PUT", "/rooms/"+publicRoom+"/members/"+u.name, owner.token, map[string]string{"role": "member"}); code != http.StatusForbidden {
+		t.Errorf("setting a role in %s: %d, want 403", publicRoom, code)
+	}
+	if code, _ := api(t, "GET", "/rooms/"+room+"/members", u.token, nil); code != http.StatusForbidden {
+		t.Errorf("members after leaving: %d, want 403", code)
+	}
+}
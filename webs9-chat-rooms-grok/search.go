@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"webs9-chat-db/logging"
+	"webs9-chat-db/store"
+)
+
+// Search needs FTS5, which go-sqlite3 only compiles in with -tags sqlite_fts5.
+// Without it the server runs with search disabled, unless -require-search is
+// set.
+var searchEnabled bool
+
+var errSearchDisabled = errors.New("search is not available")
+
+// initSearch creates the full-text index over messages.content and the
+// triggers keeping it in sync with inserts, edits and deletes
+func initSearch() {
+	var exists int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&exists)
+
+	var fts5 bool
+	db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+	if !fts5 {
+		switch {
+		case exists > 0 && *storeSpec == "sqlite":
+			// The index triggers would fail every insert into messages
+			logging.Fatal("Database has a search index but SQLite was built without FTS5, rebuild with -tags sqlite_fts5")
+		case *requireSearch && *storeSpec == "sqlite":
+			logging.Fatal("-require-search is set but SQLite was built without FTS5, rebuild with -tags sqlite_fts5")
+		}
+		slog.Warn("SQLite built without FTS5 (use -tags sqlite_fts5), search disabled")
+		return
+	}
+
+	_, err := db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			content, content='messages', content_rowid='id'
+		);
+
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+		END;
+	`)
+	if err != nil {
+		logging.Fatal("Creating search index", "err", err)
+	}
+
+	if exists == 0 {
+		// Index the messages written before the index existed
+		if _, err := db.Exec("INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')"); err != nil {
+			logging.Fatal("Building search index", "err", err)
+		}
+	}
+	searchEnabled = true
+}
+
+// ftsQuery turns user input into an FTS5 query matching all of its words, so
+// FTS5 operators typed by users are taken literally
+func ftsQuery(q string) string {
+	words := strings.Fields(q)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// searchMessages finds messages matching q in the rooms userID may read, or
+// only in room if it is set. Results are ordered by relevance.
+func searchMessages(q, room, userID string, limit int) ([]Message, error) {
+	rooms := []string{room}
+	if room == "" {
+		var err error
+		if rooms, err = readableRooms(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	stored, err := messageStore.Search(q, rooms, limit)
+	if errors.Is(err, store.ErrSearchUnsupported) {
+		return nil, errSearchDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs := []Message{}
+	for _, sm := range stored {
+		msgs = append(msgs, Message{Type: "message", ID: sm.ID, Seq: sm.Seq, Room: sm.Room, Username: sm.Username,
+			Timestamp: sm.Timestamp.Format(time.RFC3339), Snippet: highlight(sm.Snippet)})
+	}
+	return msgs, nil
+}
+
+// readableRooms lists the public room and the rooms userID is a member of
+func readableRooms(userID string) ([]string, error) {
+	rooms := []string{publicRoom}
+	if userID == "" {
+		return rooms, nil
+	}
+	rows, err := db.Query("SELECT room FROM room_members WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// highlight HTML-escapes a snippet and wraps the matches in <mark>
+func highlight(snippet string) string {
+	s := html.EscapeString(snippet)
+	s = strings.ReplaceAll(s, store.MarkOpen, "<mark>")
+	return strings.ReplaceAll(s, store.MarkClose, "</mark>")
+}
+
+// canSearch checks that userID may read room; an empty room means all of
+// the rooms they may read
+func canSearch(room, userID string) bool {
+	if room == "" {
+		return true
+	}
+	r, err := roleOf(room, userID)
+	return err == nil && r.canRead()
+}
+
+// sendSearchResults answers a websocket "search" request
+func (c *Client) sendSearchResults(q, room string, limit int) {
+	userID := ""
+	if s := c.sess.Load(); s != nil {
+		userID = s.userID
+	}
+	if strings.TrimSpace(q) == "" {
+		c.reply(Message{Type: "error", Content: "Empty search"})
+		return
+	}
+	if !canSearch(room, userID) {
+		c.reply(Message{Type: "error", Content: "Not allowed to read this room"})
+		return
+	}
+
+	msgs, err := searchMessages(q, room, userID, pageSize(limit))
+	if err != nil {
+		if !errors.Is(err, errSearchDisabled) {
+			slog.Error("DB search error", "err", err)
+		}
+		c.reply(Message{Type: "error", Content: "Search failed"})
+		return
+	}
+	c.reply(Message{Type: "search_results", Room: room, Content: q, Messages: msgs, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// searchHandler serves GET /search?q=...&room=...&limit=N. Without a token
+// only the public room is searched.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	text := q.Get("q")
+	room := q.Get("room")
+	if strings.TrimSpace(text) == "" {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+
+	userID := ""
+	if r.Header.Get("Authorization") != "" {
+		s, err := sessionFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = s.userID
+	} else if room == "" {
+		room = publicRoom
+	}
+	if !canSearch(room, userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	msgs, err := searchMessages(text, room, userID, pageSize(limit))
+	if errors.Is(err, errSearchDisabled) {
+		http.Error(w, "Search unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.Error("DB search error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"query": text, "results": msgs})
+}
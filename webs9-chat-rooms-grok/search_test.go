@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"webs9-chat-db/store"
+)
+
+func TestFTSQuery(t *testing.T) {
+	cases := map[string]string{
+		"hello world":   `"hello" "world"`,
+		`say "hi" OR *`: `"say" """hi""" "OR" "*"`,
+		"  ":            "",
+	}
+	for in, want := range cases {
+		if got := ftsQuery(in); got != want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := highlight("<b>" + store.MarkOpen + "cat" + store.MarkClose + "</b>")
+	if want := "&lt;b&gt;<mark>cat</mark>&lt;/b&gt;"; got != want {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+}
+
+type searchResponse struct {
+	Query   string    `json:"query"`
+	Results []Message `json:"results"`
+}
+
+// TestSearch checks access to search and, when the binary is built with
+// -tags sqlite_fts5, its results
+func TestSearch(t *testing.T) {
+	owner, outsider := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	word := uniqueName("needle")
+	dial(t, room, owner).chat("a " + word + " in the room")
+	dial(t, publicRoom, owner).chat("a " + word + " in public")
+
+	search := func(token, query string) (int, searchResponse) {
+		t.Helper()
+		code, body := api(t, "GET", "/search?"+query, token, nil)
+		var resp searchResponse
+		if code == http.StatusOK {
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, resp
+	}
+
+	cases := []struct {
+		token, query string
+		want         int
+	}{
+		{owner.token, "q=+", http.StatusBadRequest},
+		{owner.token, "q=x&limit=-1", http.StatusBadRequest},
+		{"not-a-token", "q=x", http.StatusUnauthorized},
+		{outsider.token, "q=x&room=" + room, http.StatusForbidden},
+		{"", "q=x&room=" + room, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if code, _ := search(c.token, c.query); code != c.want {
+			t.Errorf("search %s: %d, want %d", c.query, code, c.want)
+		}
+	}
+
+	c := dial(t, publicRoom, outsider)
+	c.send(Message{Type: "search", Content: word})
+	m := c.nextOf("search_results", "error")
+
+	q := "q=" + url.QueryEscape(word)
+	if !searchEnabled {
+		if code, _ := search(owner.token, q); code != http.StatusServiceUnavailable {
+			t.Errorf("search without FTS5: %d, want 503", code)
+		}
+		if m.Type != "error" {
+			t.Errorf("websocket search without FTS5: %+v, want an error", m)
+		}
+		return
+	}
+
+	// Each user finds only what they may read
+	if _, resp := search(owner.token, q); len(resp.Results) != 2 {
+		t.Errorf("owner found %+v, want both messages", resp.Results)
+	}
+	if _, resp := search("", q); len(resp.Results) != 1 || resp.Results[0].Room != publicRoom {
+		t.Errorf("anonymous search found %+v, want the public message", resp.Results)
+	}
+	if m.Type != "search_results" || len(m.Messages) != 1 || m.Messages[0].Room != publicRoom {
+		t.Errorf("outsider found %+v, want the public message", m)
+	}
+	if _, resp := search(owner.token, q+"&room="+room); len(resp.Results) != 1 || resp.Results[0].Snippet == "" {
+		t.Errorf("search in %s found %+v", room, resp.Results)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Set once shutdown starts; new websocket connections are refused.
+	// admitMu orders it with writePumps.Add, so Wait never races an Add.
+	shuttingDown atomic.Bool
+	admitMu      sync.Mutex
+
+	// Running writePumps, waited for so clients get their close frames
+	writePumps sync.WaitGroup
+)
+
+// admit counts a new connection's writePump unless shutdown started. The
+// caller must call writePumps.Done if it never starts the writePump.
+func admit() bool {
+	admitMu.Lock()
+	defer admitMu.Unlock()
+	if shuttingDown.Load() {
+		return false
+	}
+	writePumps.Add(1)
+	return true
+}
+
+// shutdownOnSignal stops the server on SIGINT or SIGTERM: it stops taking
+// requests, lets the hub deliver and store what is queued, closes every
+// client with 1001 and a reconnect hint, and exits once the clients are
+// closed or -shutdown-timeout passed. A second signal exits at once.
+func shutdownOnSignal(srv *http.Server) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	slog.Info("Shutting down", "timeout", shutdownTimeout.String())
+	admitMu.Lock()
+	shuttingDown.Store(true)
+	admitMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("HTTP shutdown error", "err", err)
+		}
+		hub.stop()
+		writePumps.Wait()
+		close(done)
+	}()
+
+	code := 0
+	select {
+	case <-done:
+		slog.Info("All clients closed")
+	case <-ctx.Done():
+		slog.Warn("Shutdown deadline passed, exiting anyway")
+		code = 1
+	case <-stop:
+		slog.Warn("Second signal, exiting now")
+		code = 1
+	}
+
+	if err := hub.bus.Close(); err != nil {
+		slog.Error("Closing bus", "err", err)
+	}
+	if err := messageStore.Close(); err != nil {
+		slog.Error("Closing message store", "err", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Closing DB", "err", err)
+	}
+	os.Exit(code)
+}
+
+// stop makes the hub goroutine finish: it handles the chat messages and
+// events already queued, waits until the writer stored every message, and
+// closes all clients
+func (h *Hub) stop() {
+	done := make(chan struct{})
+	h.shutdown <- done
+	<-done
+}
+
+// drainAndClose is the hub's last step, run by the hub goroutine
+func (h *Hub) drainAndClose() {
+	for drained := false; !drained; {
+		select {
+		case message := <-h.broadcast:
+			h.publish(message)
+		case event := <-h.notify:
+			h.fanOut(event)
+		case m := <-h.direct:
+			h.deliverDM(m)
+		default:
+			drained = true
+		}
+	}
+
+	h.writer.close()
+	for results := range h.writer.results {
+		h.persisted(results)
+	}
+	h.flushEvents()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		// Spread reconnects out so clients don't all come back at once
+		wait := *reconnectAfter + rand.N(*reconnectAfter+1)
+		select {
+		case client.send <- marshal(Message{
+			Type:       "shutdown",
+			Content:    "Server restarting, reconnect shortly",
+			RetryAfter: wait.Milliseconds(),
+			Timestamp:  time.Now().Format(time.RFC3339),
+		}):
+		default:
+		}
+		reason := fmt.Sprintf("server restarting, reconnect in %ds", int(wait.Round(time.Second).Seconds()))
+		h.removeClient(client, websocket.FormatCloseMessage(websocket.CloseGoingAway, reason))
+	}
+}
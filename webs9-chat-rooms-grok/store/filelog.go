@@ -0,0 +1,375 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size at which the log moves on to a new segment
+const DefaultSegmentSize = 8 << 20
+
+// FileLog is an append-only log of JSON records in numbered segment files,
+// 000001.log, 000002.log and so on. The whole log is replayed into memory on
+// open, and reads are served from there.
+type FileLog struct {
+	*Memory
+
+	dir         string
+	segmentSize int64
+	segment     int
+	file        *os.File
+	size        int64
+}
+
+// logRecord is one line of a segment
+type logRecord struct {
+	Op      string    `json:"op"` // snapshot, append, edit, delete or purge
+	Message *Message  `json:"message,omitempty"`
+	ID      int64     `json:"id,omitempty"`
+	Content string    `json:"content,omitempty"`
+	At      time.Time `json:"at,omitzero"`
+
+	// Purge arguments; At is its before
+	Room  string `json:"room,omitempty"`
+	Keep  int    `json:"keep,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+func OpenFileLog(dir string, segmentSize int64) (*FileLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &FileLog{Memory: NewMemory(0), dir: dir, segmentSize: segmentSize}
+	for _, n := range segments {
+		if err := l.replay(n); err != nil {
+			return nil, err
+		}
+	}
+
+	l.segment = 1
+	if len(segments) > 0 {
+		l.segment = segments[len(segments)-1]
+	}
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func segmentPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.log", n))
+}
+
+// listSegments returns the segment numbers in dir in order
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil && n > 0 {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// replay applies the records of one segment. A torn last line, left by a
+// crash mid-write, is ignored; anything else unreadable is an error.
+func (l *FileLog) replay(n int) error {
+	path := segmentPath(l.dir, n)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			return nil
+		}
+		if err != nil {
+			return nil
+		}
+		var rec logRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		switch rec.Op {
+		case "snapshot":
+			// Everything before was compacted into the records that follow
+			l.resetLocked()
+			l.lastID = rec.ID
+		case "append":
+			if rec.Message != nil {
+				l.appendLocked(rec.Message)
+			}
+		case "edit":
+			l.editLocked(rec.ID, rec.Content, rec.At)
+		case "delete":
+			l.deleteLocked(rec.ID)
+		case "purge":
+			l.purgeLocked(rec.Room, rec.At, rec.Keep, rec.Limit)
+		default:
+			return fmt.Errorf("%s:%d: unknown op %q", path, line, rec.Op)
+		}
+	}
+}
+
+// openSegment opens the current segment for appending, cutting off a torn
+// last line
+func (l *FileLog) openSegment() error {
+	path := segmentPath(l.dir, l.segment)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size := int64(strings.LastIndexByte(string(data), '\n') + 1)
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(size, 0); err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, size
+	return nil
+}
+
+// write appends records to the log in one write and syncs it, starting a
+// new segment when the current one is full. Records that fail to make it
+// to disk are cut off again, so they aren't replayed. The caller must hold
+// l.mu.
+func (l *FileLog) write(recs ...logRecord) error {
+	var data []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if l.size > 0 && l.size+int64(len(data)) > l.segmentSize {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.segment++
+		if err := l.openSegment(); err != nil {
+			return err
+		}
+	}
+	_, err := l.file.Write(data)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, 0)
+		return err
+	}
+	l.size += int64(len(data))
+	return nil
+}
+
+func (l *FileLog) Append(m *Message) error {
+	return l.AppendBatch([]*Message{m})
+}
+
+// AppendBatch logs msgs with one write and one sync
+func (l *FileLog) AppendBatch(msgs []*Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var recs []logRecord
+	var fresh []*Message
+	queued := make(map[string]*Message) // by user ID and client_msg_id
+	seqs := make(map[string]int64)      // last seq per room
+	for _, m := range msgs {
+		if l.duplicateLocked(m) {
+			continue
+		}
+		key := cidKey(m.UserID, m.ClientMsgID)
+		if first := queued[key]; first != nil {
+			*m = *first
+			m.Duplicate = true
+			continue
+		}
+		if _, ok := seqs[m.Room]; !ok {
+			seqs[m.Room] = l.lastSeqLocked(m.Room)
+		}
+		seqs[m.Room]++
+		m.ID, m.Seq = l.lastID+int64(len(fresh))+1, seqs[m.Room]
+		if m.UserID != "" && m.ClientMsgID != "" {
+			queued[key] = m
+		}
+		recs = append(recs, logRecord{Op: "append", Message: m})
+		fresh = append(fresh, m)
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	if err := l.write(recs...); err != nil {
+		for _, m := range fresh {
+			m.ID = 0
+		}
+		return err
+	}
+	for _, m := range fresh {
+		l.appendLocked(m)
+	}
+	return nil
+}
+
+func (l *FileLog) Edit(id int64, content string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.byID[id]; !ok {
+		return ErrNotFound
+	}
+	if err := l.write(logRecord{Op: "edit", ID: id, Content: content, At: at}); err != nil {
+		return err
+	}
+	return l.editLocked(id, content, at)
+}
+
+func (l *FileLog) Delete(id int64, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.byID[id]; !ok {
+		return ErrNotFound
+	}
+	if err := l.write(logRecord{Op: "delete", ID: id, At: at}); err != nil {
+		return err
+	}
+	return l.deleteLocked(id)
+}
+
+// Purge logs the purge itself, which replays to the same result. Segments
+// keep the purged records until Compact rewrites them.
+func (l *FileLog) Purge(room string, before time.Time, keep, limit int) ([]int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.purgeable(room, before, keep) {
+		return nil, nil
+	}
+	if err := l.write(logRecord{Op: "purge", Room: room, At: before, Keep: keep, Limit: limit}); err != nil {
+		return nil, err
+	}
+	return l.purgeLocked(room, before, keep, limit), nil
+}
+
+// Compact writes the stored messages to a new segment starting with a
+// snapshot record and removes the older segments. The segment is written
+// under a temporary name and renamed once synced, so a crash leaves either
+// the old segments or the snapshot; older segments left behind by a crash
+// are harmless, since replaying the snapshot record resets the state.
+func (l *FileLog) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var msgs []*Message
+	for _, room := range l.rooms {
+		msgs = append(msgs, room...)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+
+	n := l.segment + 1
+	path := segmentPath(l.dir, n)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(logRecord{Op: "snapshot", ID: l.lastID})
+	for _, m := range msgs {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(logRecord{Op: "append", Message: m})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.segment = n
+	if err := l.openSegment(); err != nil {
+		return err
+	}
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, i := range segments {
+		if i < n {
+			if err := os.Remove(segmentPath(l.dir, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T, dir string, segmentSize int64) *FileLog {
+	t.Helper()
+	l, err := OpenFileLog(dir, segmentSize)
+	if err != nil {
+		t.Fatalf("OpenFileLog: %v", err)
+	}
+	return l
+}
+
+func TestFileLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	old := time.Now().Add(-time.Hour).UTC()
+	appendAll(t, l,
+		Message{Room: "a", Content: "one", Timestamp: old},
+		Message{Room: "a", Content: "two", Timestamp: old, UserID: "u1", ClientMsgID: "c2"},
+		Message{Room: "a", Content: "three", Timestamp: old},
+	)
+	at := time.Now().UTC()
+	if err := l.Edit(2, "edited", at); err != nil {
+		t.Fatalf("Edit: %v", err)
+	}
+	if err := l.Delete(3, at); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := l.Purge("a", time.Time{}, 2, 10); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	l.Close()
+
+	l = openLog(t, dir, DefaultSegmentSize)
+	defer l.Close()
+	got, _ := l.Range("a", 0, 10)
+	if !equal(seqs(got), []int64{2, 3}) {
+		t.Fatalf("replayed seqs %v, want [2 3]", seqs(got))
+	}
+	if got[0].Content != "edited" || !got[0].EditedAt.Equal(at) {
+		t.Errorf("edit not replayed: %q at %v", got[0].Content, got[0].EditedAt)
+	}
+	if !got[1].Deleted {
+		t.Error("delete not replayed")
+	}
+	if m, err := l.FindByClientID("u1", "c2"); err != nil || m.ID != 2 {
+		t.Errorf("FindByClientID after replay = %d, %v", m.ID, err)
+	}
+
+	m := Message{Room: "a"}
+	if err := l.Append(&m); err != nil || m.ID != 4 {
+		t.Errorf("Append after replay got ID %d, %v, want 4", m.ID, err)
+	}
+}
+
+func TestFileLogTornLine(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	appendAll(t, l, Message{Room: "a"}, Message{Room: "a"})
+	l.Close()
+
+	// A crash in the middle of writing the third record
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"append","message":{"id":3,"room":"a","se`)
+	f.Close()
+
+	l = openLog(t, dir, DefaultSegmentSize)
+	if got, _ := l.Range("a", 0, 10); !equal(seqs(got), []int64{1, 2}) {
+		t.Fatalf("seqs after torn line %v, want [1 2]", seqs(got))
+	}
+	m := Message{Room: "a"}
+	if err := l.Append(&m); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	l.Close()
+
+	// The torn line was cut off, so the new record replays cleanly
+	l = openLog(t, dir, DefaultSegmentSize)
+	defer l.Close()
+	if got, _ := l.Range("a", 0, 10); !equal(seqs(got), []int64{1, 2, 3}) {
+		t.Errorf("seqs after reopening %v, want [1 2 3]", seqs(got))
+	}
+}
+
+func TestFileLogCorruptLine(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	appendAll(t, l, Message{Room: "a"})
+	l.Close()
+
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+
+	if _, err := OpenFileLog(dir, DefaultSegmentSize); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("OpenFileLog err = %v, want an error for line 2", err)
+	}
+}
+
+func TestFileLogSegments(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, 200)
+	for i := int64(1); i <= 10; i++ {
+		appendAll(t, l, Message{Room: "a", Content: "message"})
+	}
+	l.Close()
+
+	segments, _ := listSegments(dir)
+	if len(segments) < 2 {
+		t.Fatalf("got %d segments, want several", len(segments))
+	}
+	l = openLog(t, dir, 200)
+	defer l.Close()
+	if seq, _ := l.LastSeq("a"); seq != 10 {
+		t.Errorf("LastSeq after replaying segments = %d, want 10", seq)
+	}
+}
+
+func TestFileLogAppendBatch(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	appendAll(t, l, Message{Room: "a"})
+	batch := []*Message{{Room: "a"}, {Room: "b"}}
+	if err := l.AppendBatch(batch); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if batch[0].ID != 2 || batch[1].ID != 3 {
+		t.Errorf("batch IDs %d, %d, want 2, 3", batch[0].ID, batch[1].ID)
+	}
+	if batch[0].Seq != 2 || batch[1].Seq != 1 {
+		t.Errorf("batch seqs %d, %d, want 2, 1: seqs count per room", batch[0].Seq, batch[1].Seq)
+	}
+	l.Close()
+
+	l = openLog(t, dir, DefaultSegmentSize)
+	defer l.Close()
+	if m, err := l.Get(3); err != nil || m.Room != "b" {
+		t.Errorf("Get(3) after replay = %+v, %v", m, err)
+	}
+}
+
+func TestFileLogAppendBatchDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	defer l.Close()
+	appendAll(t, l, Message{Room: "a", UserID: "u1", ClientMsgID: "c1"})
+
+	batch := []*Message{
+		{Room: "a", UserID: "u1", ClientMsgID: "c1"},
+		{Room: "a", UserID: "u1", ClientMsgID: "c2"},
+		{Room: "a", UserID: "u1", ClientMsgID: "c2"},
+	}
+	if err := l.AppendBatch(batch); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if !batch[0].Duplicate || batch[0].ID != 1 {
+		t.Errorf("retry of a stored message = %+v, want a duplicate of ID 1", batch[0])
+	}
+	if batch[1].Duplicate || batch[1].ID != 2 {
+		t.Errorf("new message = %+v, want ID 2", batch[1])
+	}
+	if !batch[2].Duplicate || batch[2].ID != 2 || batch[2].Seq != 2 {
+		t.Errorf("retry within the batch = %+v, want a duplicate of ID 2", batch[2])
+	}
+	if got, _ := l.Range("a", 0, 10); !equal(seqs(got), []int64{1, 2}) {
+		t.Errorf("stored seqs %v, want [1 2]", seqs(got))
+	}
+}
+
+func TestFileLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, 200)
+	old := time.Now().Add(-time.Hour).UTC()
+	for i := int64(1); i <= 10; i++ {
+		appendAll(t, l, Message{Room: "a", Content: "message", Timestamp: old})
+	}
+	l.Edit(9, "edited", time.Now().UTC())
+	if _, err := l.Purge("a", time.Time{}, 2, 100); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("files after Compact: %v, want one segment", files)
+	}
+	appendAll(t, l, Message{Room: "a"})
+	l.Close()
+
+	l = openLog(t, dir, 200)
+	defer l.Close()
+	got, _ := l.Range("a", 0, 100)
+	if !equal(seqs(got), []int64{9, 10, 11}) {
+		t.Fatalf("seqs after compacting %v, want [9 10 11]", seqs(got))
+	}
+	if got[0].Content != "edited" {
+		t.Errorf("edit lost by compacting, content %q", got[0].Content)
+	}
+	if got[2].ID != 11 {
+		t.Errorf("ID after compacting = %d, want 11", got[2].ID)
+	}
+}
+
+func TestFileLogCompactKeepsLastID(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, DefaultSegmentSize)
+	appendAll(t, l, Message{Room: "a"}, Message{Room: "a"})
+	l.Purge("a", time.Time{}, 0, 10)
+	if err := l.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	l.Close()
+
+	l = openLog(t, dir, DefaultSegmentSize)
+	defer l.Close()
+	m := Message{Room: "a"}
+	if err := l.Append(&m); err != nil || m.ID != 3 {
+		t.Errorf("Append after compacting everything got ID %d, %v, want 3", m.ID, err)
+	}
+}
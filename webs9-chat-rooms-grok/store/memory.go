@@ -0,0 +1,341 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps messages in memory. With a limit, only the newest limit
+// messages of each room are kept.
+type Memory struct {
+	mu      sync.RWMutex
+	limit   int
+	lastID  int64
+	rooms   map[string][]*Message // in append order, so by ID and seq
+	byID    map[int64]*Message
+	byCID   map[string]*Message // by user ID and client_msg_id
+	replies map[int64]int       // live replies per thread root
+}
+
+func NewMemory(limit int) *Memory {
+	return &Memory{
+		limit:   limit,
+		rooms:   make(map[string][]*Message),
+		byID:    make(map[int64]*Message),
+		byCID:   make(map[string]*Message),
+		replies: make(map[int64]int),
+	}
+}
+
+func cidKey(userID, clientMsgID string) string {
+	return userID + "\x00" + clientMsgID
+}
+
+// The *Locked methods do the work of the exported ones for callers holding
+// s.mu, so FileLog can log and apply a change as one step.
+
+func (s *Memory) appendLocked(m *Message) {
+	if m.ID == 0 {
+		m.ID = s.lastID + 1
+	}
+	s.lastID = max(s.lastID, m.ID)
+
+	stored := *m
+	stored.ReplyCount, stored.Snippet = 0, ""
+	s.rooms[m.Room] = append(s.rooms[m.Room], &stored)
+	s.byID[m.ID] = &stored
+	if m.UserID != "" && m.ClientMsgID != "" {
+		s.byCID[cidKey(m.UserID, m.ClientMsgID)] = &stored
+	}
+	if m.ParentID != 0 && !m.Deleted {
+		s.replies[m.ParentID]++
+	}
+
+	if s.limit > 0 && len(s.rooms[m.Room]) > s.limit {
+		s.removeLocked(s.rooms[m.Room][0])
+	}
+}
+
+// resetLocked forgets every message
+func (s *Memory) resetLocked() {
+	s.lastID = 0
+	s.rooms = make(map[string][]*Message)
+	s.byID = make(map[int64]*Message)
+	s.byCID = make(map[string]*Message)
+	s.replies = make(map[int64]int)
+}
+
+// removeLocked forgets the oldest message of its room
+func (s *Memory) removeLocked(m *Message) {
+	msgs := s.rooms[m.Room]
+	s.rooms[m.Room] = msgs[1:]
+	if len(s.rooms[m.Room]) == 0 {
+		delete(s.rooms, m.Room)
+	}
+	delete(s.byID, m.ID)
+	if m.UserID != "" && m.ClientMsgID != "" {
+		delete(s.byCID, cidKey(m.UserID, m.ClientMsgID))
+	}
+	if m.ParentID != 0 && !m.Deleted {
+		s.replies[m.ParentID]--
+	}
+	delete(s.replies, m.ID)
+}
+
+// purgeable reports whether the oldest message of room is due for a purge
+func (s *Memory) purgeable(room string, before time.Time, keep int) bool {
+	msgs := s.rooms[room]
+	return len(msgs) > keep && (before.IsZero() || msgs[0].Timestamp.Before(before))
+}
+
+func (s *Memory) purgeLocked(room string, before time.Time, keep, limit int) []int64 {
+	var ids []int64
+	for len(ids) < limit && s.purgeable(room, before, keep) {
+		oldest := s.rooms[room][0]
+		ids = append(ids, oldest.ID)
+		s.removeLocked(oldest)
+	}
+	return ids
+}
+
+func (s *Memory) editLocked(id int64, content string, at time.Time) error {
+	m, ok := s.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Content, m.EditedAt = content, at
+	return nil
+}
+
+func (s *Memory) deleteLocked(id int64) error {
+	m, ok := s.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !m.Deleted && m.ParentID != 0 {
+		s.replies[m.ParentID]--
+	}
+	m.Content, m.Deleted = "", true
+	return nil
+}
+
+// out copies a stored message for a caller
+func (s *Memory) out(m *Message) Message {
+	c := *m
+	c.ReplyCount = s.replies[m.ID]
+	return c
+}
+
+// duplicateLocked replaces m by the copy stored under its client_msg_id and
+// reports whether there was one
+func (s *Memory) duplicateLocked(m *Message) bool {
+	if m.UserID == "" || m.ClientMsgID == "" {
+		return false
+	}
+	stored, ok := s.byCID[cidKey(m.UserID, m.ClientMsgID)]
+	if !ok {
+		return false
+	}
+	*m = s.out(stored)
+	m.Duplicate = true
+	return true
+}
+
+func (s *Memory) Append(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.duplicateLocked(m) {
+		return nil
+	}
+	m.ID, m.Seq = 0, s.lastSeqLocked(m.Room)+1
+	s.appendLocked(m)
+	return nil
+}
+
+func (s *Memory) Get(id int64) (Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.byID[id]
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	return s.out(m), nil
+}
+
+func (s *Memory) FindByClientID(userID, clientMsgID string) (Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.byCID[cidKey(userID, clientMsgID)]
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	return s.out(m), nil
+}
+
+func (s *Memory) lastSeqLocked(room string) int64 {
+	msgs := s.rooms[room]
+	if len(msgs) == 0 {
+		return 0
+	}
+	return msgs[len(msgs)-1].Seq
+}
+
+func (s *Memory) LastSeq(room string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSeqLocked(room), nil
+}
+
+func (s *Memory) Range(room string, after, upTo int64) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := s.rooms[room]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > after })
+	var out []Message
+	for ; i < len(msgs) && msgs[i].Seq <= upTo; i++ {
+		out = append(out, s.out(msgs[i]))
+	}
+	return out, nil
+}
+
+func (s *Memory) Before(room string, before int64, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := s.rooms[room]
+	end := len(msgs)
+	if before > 0 {
+		end = sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= before })
+	}
+	start := max(0, end-limit)
+	var out []Message
+	for _, m := range msgs[start:end] {
+		out = append(out, s.out(m))
+	}
+	return out, nil
+}
+
+func (s *Memory) Replies(parentID, after int64, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, ok := s.byID[parentID]
+	if !ok {
+		return nil, nil
+	}
+	msgs := s.rooms[root.Room]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID > after })
+	var out []Message
+	for ; i < len(msgs) && len(out) < limit; i++ {
+		if msgs[i].ParentID == parentID {
+			out = append(out, s.out(msgs[i]))
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) Edit(id int64, content string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.editLocked(id, content, at)
+}
+
+func (s *Memory) Delete(id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteLocked(id)
+}
+
+func (s *Memory) Rooms() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (s *Memory) Purge(room string, before time.Time, keep, limit int) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.purgeLocked(room, before, keep, limit), nil
+}
+
+// Search does a plain case-insensitive scan for messages containing every
+// word of q, newest first
+func (s *Memory) Search(q string, rooms []string, limit int) ([]Message, error) {
+	words := strings.Fields(strings.ToLower(q))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Message
+	for _, room := range rooms {
+		for _, m := range s.rooms[room] {
+			text := strings.ToLower(m.Content)
+			if m.Deleted || !containsAll(text, words) {
+				continue
+			}
+			hit := s.out(m)
+			hit.Snippet = markWords(m.Content, words)
+			out = append(out, hit)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *Memory) Close() error { return nil }
+
+func containsAll(text string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// markWords wraps each occurrence of the (lowercase) words in MarkOpen and
+// MarkClose
+func markWords(content string, words []string) string {
+	lower := strings.ToLower(content)
+	if len(lower) != len(content) {
+		// Case folding changed byte offsets; leave the text unmarked
+		return content
+	}
+	marked := make([]bool, len(content))
+	for _, w := range words {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], w)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(w); k++ {
+				marked[k] = true
+			}
+			i += j + len(w)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(content); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(MarkOpen)
+		}
+		if !marked[i] && i > 0 && marked[i-1] {
+			b.WriteString(MarkClose)
+		}
+		b.WriteByte(content[i])
+	}
+	if len(content) > 0 && marked[len(content)-1] {
+		b.WriteString(MarkClose)
+	}
+	return b.String()
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func appendAll(t *testing.T, s MessageStore, msgs ...Message) []int64 {
+	t.Helper()
+	ids := make([]int64, len(msgs))
+	for i := range msgs {
+		if err := s.Append(&msgs[i]); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		ids[i] = msgs[i].ID
+	}
+	return ids
+}
+
+func seqs(msgs []Message) []int64 {
+	out := make([]int64, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Seq
+	}
+	return out
+}
+
+func equal(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryAppendAndRead(t *testing.T) {
+	s := NewMemory(0)
+	ids := appendAll(t, s,
+		Message{Room: "a", Content: "one", UserID: "u1", ClientMsgID: "c1"},
+		Message{Room: "b", Content: "other room"},
+		Message{Room: "a", Content: "two"},
+		Message{Room: "a", Content: "three"},
+	)
+	if !equal(ids, []int64{1, 2, 3, 4}) {
+		t.Fatalf("IDs = %v, want 1..4", ids)
+	}
+
+	if seq, _ := s.LastSeq("a"); seq != 3 {
+		t.Errorf("LastSeq(a) = %d, want 3", seq)
+	}
+	if seq, _ := s.LastSeq("none"); seq != 0 {
+		t.Errorf("LastSeq(none) = %d, want 0", seq)
+	}
+	if got, _ := s.Range("a", 1, 3); !equal(seqs(got), []int64{2, 3}) {
+		t.Errorf("Range(a, 1, 3) seqs = %v, want [2 3]", seqs(got))
+	}
+	if got, _ := s.Before("a", 4, 1); !equal(seqs(got), []int64{2}) {
+		t.Errorf("Before(a, 4, 1) seqs = %v, want [2]", seqs(got))
+	}
+	if got, _ := s.Before("a", 0, 10); !equal(seqs(got), []int64{1, 2, 3}) {
+		t.Errorf("Before(a, 0, 10) seqs = %v, want [1 2 3]", seqs(got))
+	}
+
+	m, err := s.FindByClientID("u1", "c1")
+	if err != nil || m.ID != 1 {
+		t.Errorf("FindByClientID = %d, %v, want message 1", m.ID, err)
+	}
+	if _, err := s.FindByClientID("u2", "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FindByClientID of another user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryEditDeleteAndReplies(t *testing.T) {
+	s := NewMemory(0)
+	appendAll(t, s,
+		Message{Room: "a", Content: "root"},
+		Message{Room: "a", Content: "reply 1", ParentID: 1},
+		Message{Room: "a", Content: "reply 2", ParentID: 1},
+	)
+	if m, _ := s.Get(1); m.ReplyCount != 2 {
+		t.Errorf("ReplyCount = %d, want 2", m.ReplyCount)
+	}
+
+	at := time.Now()
+	if err := s.Edit(2, "edited", at); err != nil {
+		t.Fatalf("Edit: %v", err)
+	}
+	if m, _ := s.Get(2); m.Content != "edited" || !m.EditedAt.Equal(at) {
+		t.Errorf("after Edit got %q at %v", m.Content, m.EditedAt)
+	}
+
+	if err := s.Delete(3, at); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	m, _ := s.Get(3)
+	if !m.Deleted || m.Content != "" {
+		t.Errorf("after Delete got deleted=%v content=%q", m.Deleted, m.Content)
+	}
+	if m, _ := s.Get(1); m.ReplyCount != 1 {
+		t.Errorf("ReplyCount after delete = %d, want 1", m.ReplyCount)
+	}
+	if got, _ := s.Replies(1, 0, 10); len(got) != 2 {
+		t.Errorf("Replies kept %d messages, want 2 with the tombstone", len(got))
+	}
+
+	if err := s.Edit(99, "x", at); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Edit of unknown ID: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	s := NewMemory(2)
+	appendAll(t, s,
+		Message{Room: "a"},
+		Message{Room: "a"},
+		Message{Room: "a"},
+		Message{Room: "b"},
+	)
+	if got, _ := s.Range("a", 0, 10); !equal(seqs(got), []int64{2, 3}) {
+		t.Errorf("room a seqs = %v, want [2 3]", seqs(got))
+	}
+	if _, err := s.Get(1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("evicted message: err = %v, want ErrNotFound", err)
+	}
+	if m, _ := s.Get(4); m.Room != "b" {
+		t.Errorf("IDs kept counting after eviction, got room %q for ID 4", m.Room)
+	}
+}
+
+func TestMemoryPurge(t *testing.T) {
+	s := NewMemory(0)
+	old := time.Now().Add(-time.Hour)
+	appendAll(t, s,
+		Message{Room: "a", Timestamp: old},
+		Message{Room: "a", Timestamp: old},
+		Message{Room: "a", Timestamp: old},
+		Message{Room: "a", Timestamp: time.Now()},
+	)
+
+	ids, _ := s.Purge("a", time.Time{}, 3, 10)
+	if !equal(ids, []int64{1}) {
+		t.Errorf("Purge by count deleted %v, want [1]", ids)
+	}
+	ids, _ = s.Purge("a", time.Now().Add(-time.Minute), 1, 1)
+	if !equal(ids, []int64{2}) {
+		t.Errorf("Purge with limit 1 deleted %v, want [2]", ids)
+	}
+	ids, _ = s.Purge("a", time.Now().Add(-time.Minute), 1, 10)
+	if !equal(ids, []int64{3}) {
+		t.Errorf("Purge by age deleted %v, want [3]", ids)
+	}
+	if got, _ := s.Range("a", 0, 10); !equal(seqs(got), []int64{4}) {
+		t.Errorf("left seqs %v, want [4]", seqs(got))
+	}
+}
+
+func TestMemorySearch(t *testing.T) {
+	s := NewMemory(0)
+	appendAll(t, s,
+		Message{Room: "a", Content: "Hello world"},
+		Message{Room: "a", Content: "hello there"},
+		Message{Room: "b", Content: "hello world"},
+	)
+	got, err := s.Search("WORLD hello", []string{"a"}, 10)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != 1 {
+		t.Fatalf("Search found %v, want message 1", got)
+	}
+	if want := MarkOpen + "Hello" + MarkClose + " " + MarkOpen + "world" + MarkClose; got[0].Snippet != want {
+		t.Errorf("Snippet = %q, want %q", got[0].Snippet, want)
+	}
+}
+
+func TestMemorySearchNonASCII(t *testing.T) {
+	s := NewMemory(0)
+	appendAll(t, s, Message{Room: "a", Content: "café olé naïve"})
+	got, err := s.Search("olé", []string{"a"}, 10)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Search = %v, %v, want one message", got, err)
+	}
+	if want := "café " + MarkOpen + "olé" + MarkClose + " naïve"; got[0].Snippet != want {
+		t.Errorf("Snippet = %q, want %q", got[0].Snippet, want)
+	}
+}
+
+func TestMemoryDuplicate(t *testing.T) {
+	s := NewMemory(0)
+	appendAll(t, s, Message{Room: "a", Content: "first", UserID: "u1", ClientMsgID: "c1"})
+
+	retry := Message{Room: "a", Content: "retry", UserID: "u1", ClientMsgID: "c1"}
+	if err := s.Append(&retry); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if !retry.Duplicate || retry.ID != 1 || retry.Seq != 1 || retry.Content != "first" {
+		t.Errorf("retry = %+v, want the stored copy marked Duplicate", retry)
+	}
+	if seq, _ := s.LastSeq("a"); seq != 1 {
+		t.Errorf("LastSeq = %d, want 1: the retry must not be stored", seq)
+	}
+}
@@ -0,0 +1,135 @@
+// Package store keeps chat messages behind one interface, so servers can
+// switch between an in-memory store, an append-only log on disk and SQLite
+// (which lives with the server owning the schema).
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound          = errors.New("message not found")
+	ErrSearchUnsupported = errors.New("search not supported by this store")
+)
+
+// Snippet markers around search matches, for the caller to turn into markup
+const (
+	MarkOpen  = "\x02"
+	MarkClose = "\x03"
+)
+
+// Message is a stored chat message. Seq numbers messages per room and ID
+// grows across rooms; the store assigns both when appending, so servers
+// sharing a store never hand out the same one twice.
+type Message struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type,omitempty"` // kind of content, such as text or image, if the server has several
+	Room        string    `json:"room"`
+	Seq         int64     `json:"seq"`
+	UserID      string    `json:"user_id,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Content     string    `json:"content"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	ParentID    int64     `json:"parent_id,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	EditedAt    time.Time `json:"edited_at,omitzero"`
+	Deleted     bool      `json:"deleted,omitempty"`
+
+	// Filled in on reads: live replies to a thread root, and the matched
+	// text of search results
+	ReplyCount int    `json:"-"`
+	Snippet    string `json:"-"`
+
+	// Set by appends when the user already stored a message with this
+	// client_msg_id; the message then holds the stored copy
+	Duplicate bool `json:"-"`
+}
+
+// MessageStore persists messages. Implementations are safe for concurrent
+// use.
+type MessageStore interface {
+	// Append stores m and sets its ID and seq. A message whose user and
+	// client_msg_id are already stored isn't stored again; m is replaced by
+	// the stored copy with Duplicate set.
+	Append(m *Message) error
+	Get(id int64) (Message, error)
+	// FindByClientID finds the message a user sent with a client_msg_id
+	FindByClientID(userID, clientMsgID string) (Message, error)
+
+	// LastSeq is the highest seq stored in room, 0 if none
+	LastSeq(room string) (int64, error)
+	// Range returns the messages of room with after < seq <= upTo in order
+	Range(room string, after, upTo int64) ([]Message, error)
+	// Before returns up to limit messages of room older than the message
+	// with ID before (0 for the newest), in chronological order
+	Before(room string, before int64, limit int) ([]Message, error)
+	// Replies returns up to limit replies to a thread root after the reply
+	// with ID after, in order
+	Replies(parentID, after int64, limit int) ([]Message, error)
+
+	Edit(id int64, content string, at time.Time) error
+	// Delete turns a message into a tombstone, keeping its ID and seq
+	Delete(id int64, at time.Time) error
+
+	// Search finds messages matching all words of q in rooms, best first,
+	// with Snippet set. Stores without search return ErrSearchUnsupported.
+	Search(q string, rooms []string, limit int) ([]Message, error)
+
+	Close() error
+}
+
+// BatchAppender is implemented by stores that can append several messages
+// at once, all or none of them. Duplicates are handled as by Append.
+type BatchAppender interface {
+	AppendBatch(msgs []*Message) error
+}
+
+// Purger is implemented by stores that can drop old messages for retention
+type Purger interface {
+	// Rooms lists the rooms with stored messages
+	Rooms() ([]string, error)
+	// Purge deletes up to limit of the oldest messages of room that are not
+	// among its newest keep and, unless before is zero, are older than
+	// before. It returns the IDs it deleted.
+	Purge(room string, before time.Time, keep, limit int) ([]int64, error)
+}
+
+// Compacter is implemented by stores whose files don't shrink by
+// themselves when messages are purged
+type Compacter interface {
+	// Compact rewrites the store's files to hold only what is still stored
+	Compact() error
+}
+
+// Open creates a store from a config string:
+//
+//	memory        everything in memory, lost on restart
+//	memory:N      in memory, keeping the last N messages per room
+//	file:DIR      append-only log segments in DIR
+//
+// Servers handle backends of their own, such as sqlite, before calling Open.
+func Open(spec string) (MessageStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "memory":
+		limit := 0
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("store %q: limit must be a positive number", spec)
+			}
+			limit = n
+		}
+		return NewMemory(limit), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("store %q: missing directory", spec)
+		}
+		return OpenFileLog(arg, DefaultSegmentSize)
+	}
+	return nil, fmt.Errorf("unknown store %q", spec)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"webs9-chat-db/store"
+)
+
+// sqliteStore keeps messages in the messages table of db, created by initDB
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// Columns read by scanStored
+const storedColumns = `id, room, seq, COALESCE(user_id, ''), username, content, COALESCE(client_msg_id, ''),
+	COALESCE(parent_id, 0), timestamp, edited_at, deleted_at IS NOT NULL,
+	(SELECT COUNT(*) FROM messages r WHERE r.parent_id = messages.id AND r.deleted_at IS NULL)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanStored(row rowScanner) (store.Message, error) {
+	var m store.Message
+	var editedAt sql.NullTime
+	err := row.Scan(&m.ID, &m.Room, &m.Seq, &m.UserID, &m.Username, &m.Content, &m.ClientMsgID,
+		&m.ParentID, &m.Timestamp, &editedAt, &m.Deleted, &m.ReplyCount)
+	m.EditedAt = editedAt.Time
+	return m, err
+}
+
+func (s sqliteStore) queryOne(query string, args ...any) (store.Message, error) {
+	m, err := scanStored(s.db.QueryRow("SELECT "+storedColumns+" FROM messages "+query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.Message{}, store.ErrNotFound
+	}
+	return m, err
+}
+
+func (s sqliteStore) query(query string, args ...any) ([]store.Message, error) {
+	rows, err := s.db.Query("SELECT "+storedColumns+" FROM messages "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []store.Message
+	for rows.Next() {
+		m, err := scanStored(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (s sqliteStore) Append(m *store.Message) error {
+	return s.AppendBatch([]*store.Message{m})
+}
+
+// AppendBatch inserts msgs in one transaction. Each insert takes the room's
+// next seq while holding the write lock, so servers sharing the database
+// can't assign the same one. The unique index on user_id and client_msg_id
+// turns a retry into a no-op, after which the stored copy is read back.
+func (s sqliteStore) AppendBatch(msgs []*store.Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO messages (room, username, content, seq, user_id, client_msg_id, parent_id, timestamp)
+		SELECT ?, ?, ?, COALESCE(MAX(seq), 0) + 1, ?, ?, ?, ? FROM messages WHERE room = ?
+		ON CONFLICT (user_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING
+		RETURNING id, seq`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	results := make([]store.Message, len(msgs))
+	for i, m := range msgs {
+		var parentID any
+		if m.ParentID != 0 {
+			parentID = m.ParentID
+		}
+		results[i] = *m
+		err := insert.QueryRow(m.Room, m.Username, m.Content, nullIfEmpty(m.UserID), nullIfEmpty(m.ClientMsgID), parentID, m.Timestamp, m.Room).
+			Scan(&results[i].ID, &results[i].Seq)
+		if errors.Is(err, sql.ErrNoRows) {
+			stored, err := scanStored(tx.QueryRow("SELECT "+storedColumns+" FROM messages WHERE user_id = ? AND client_msg_id = ?", m.UserID, m.ClientMsgID))
+			if err != nil {
+				return err
+			}
+			stored.Duplicate = true
+			results[i] = stored
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, m := range msgs {
+		*m = results[i]
+	}
+	return nil
+}
+
+func (s sqliteStore) Get(id int64) (store.Message, error) {
+	return s.queryOne("WHERE id = ?", id)
+}
+
+func (s sqliteStore) FindByClientID(userID, clientMsgID string) (store.Message, error) {
+	return s.queryOne("WHERE user_id = ? AND client_msg_id = ?", userID, clientMsgID)
+}
+
+func (s sqliteStore) LastSeq(room string) (int64, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRow("SELECT MAX(seq) FROM messages WHERE room = ?", room).Scan(&seq)
+	return seq.Int64, err
+}
+
+func (s sqliteStore) Range(room string, after, upTo int64) ([]store.Message, error) {
+	return s.query("WHERE room = ? AND seq > ? AND seq <= ? ORDER BY seq", room, after, upTo)
+}
+
+func (s sqliteStore) Before(room string, before int64, limit int) ([]store.Message, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	msgs, err := s.query("WHERE room = ? AND id < ? ORDER BY id DESC LIMIT ?", room, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Reverse to chronological order
+	for i := len(msgs)/2 - 1; i >= 0; i-- {
+		opp := len(msgs) - 1 - i
+		msgs[i], msgs[opp] = msgs[opp], msgs[i]
+	}
+	return msgs, nil
+}
+
+func (s sqliteStore) Replies(parentID, after int64, limit int) ([]store.Message, error) {
+	return s.query("WHERE parent_id = ? AND id > ? ORDER BY id LIMIT ?", parentID, after, limit)
+}
+
+func (s sqliteStore) Edit(id int64, content string, at time.Time) error {
+	return s.update("UPDATE messages SET content = ?, edited_at = ? WHERE id = ?", content, at, id)
+}
+
+func (s sqliteStore) Delete(id int64, at time.Time) error {
+	return s.update("UPDATE messages SET content = '', deleted_at = ? WHERE id = ?", at, id)
+}
+
+func (s sqliteStore) update(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return store.ErrNotFound
+	}
+	return err
+}
+
+func (s sqliteStore) Rooms() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT room FROM messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s sqliteStore) Purge(room string, before time.Time, keep, limit int) ([]int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Oldest ID among the newest keep, which bounds the purge from above
+	bound := int64(math.MaxInt64)
+	if keep > 0 {
+		err := tx.QueryRow("SELECT id FROM messages WHERE room = ? ORDER BY id DESC LIMIT 1 OFFSET ?", room, keep-1).Scan(&bound)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := "SELECT id FROM messages WHERE room = ? AND id < ?"
+	args := []any{room, bound}
+	if !before.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, before.UTC().Format(time.DateTime))
+	}
+	rows, err := tx.Query(query+" ORDER BY id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	args = make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	if _, err := tx.Exec("DELETE FROM messages WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// Search uses the FTS5 index set up by initSearch, ordered by rank
+func (s sqliteStore) Search(q string, rooms []string, limit int) ([]store.Message, error) {
+	if !searchEnabled {
+		return nil, store.ErrSearchUnsupported
+	}
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+
+	args := []any{store.MarkOpen, store.MarkClose, ftsQuery(q)}
+	for _, room := range rooms {
+		args = append(args, room)
+	}
+	args = append(args, limit)
+	rows, err := s.db.Query(`
+		SELECT m.id, m.seq, m.room, m.username, m.timestamp,
+			snippet(messages_fts, 0, ?, ?, '…', 12)
+		FROM messages_fts JOIN messages m ON m.id = messages_fts.rowid
+		WHERE messages_fts MATCH ? AND m.room IN (?`+strings.Repeat(", ?", len(rooms)-1)+`)
+		ORDER BY rank LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []store.Message
+	for rows.Next() {
+		var m store.Message
+		if err := rows.Scan(&m.ID, &m.Seq, &m.Room, &m.Username, &m.Timestamp, &m.Snippet); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// Close leaves db open for the rest of the server
+func (s sqliteStore) Close() error { return nil }
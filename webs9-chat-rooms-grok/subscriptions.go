@@ -0,0 +1,148 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"webs9-chat-db/metrics"
+)
+
+// Most rooms one connection may be subscribed to at once
+const maxSubscriptions = 50
+
+// subscription is a client's membership of one room. Its fields are owned by
+// the hub goroutine.
+type subscription struct {
+	client *Client
+	room   string
+
+	// Role in the room, whether live messages are delivered yet, the seq the
+	// client asked to resume from (-1 if none) and the thread it narrowed
+	// delivery to (0 for the whole room)
+	role   role
+	live   bool
+	since  int64
+	thread int64
+	// Whether the client counts towards the room's presence roster
+	present bool
+	// Seq of the last message sent as history or replay before going live
+	liveAfter int64
+	// Uncounts the subscription in ws_connections
+	uncount func()
+}
+
+type subscribeRequest struct {
+	client *Client
+	room   string
+	since  int64 // -1 for recent history instead of a replay
+}
+
+// roomFor returns the room a frame is about: its room field, or the room the
+// connection was opened with
+func (c *Client) roomFor(msg Message) string {
+	if msg.Room != "" {
+		return msg.Room
+	}
+	return c.room
+}
+
+// subscribed reports whether c is subscribed to room. It is safe to call from
+// any goroutine.
+func (h *Hub) subscribed(c *Client, room string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.rooms[room][c]
+	return ok
+}
+
+// subscription returns the client's subscription to room, or nil
+func (h *Hub) subscription(c *Client, room string) *subscription {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[room][c]
+}
+
+// subscribe adds a room to a connected client, welcomes it and, if it may
+// read the room, sends the history or replay and starts live delivery.
+// Clients that can't read the room yet stay subscribed until they
+// authenticate or are invited.
+func (h *Hub) subscribe(req subscribeRequest) {
+	client := req.client
+	now := time.Now().Format(time.RFC3339)
+
+	h.mu.Lock()
+	if !h.clients[client] {
+		h.mu.Unlock()
+		return
+	}
+	if _, ok := client.subs[req.room]; ok {
+		h.mu.Unlock()
+		h.sendTo(client, Message{Type: "error", Room: req.room, Content: "Already subscribed"})
+		return
+	}
+	if len(client.subs) >= maxSubscriptions {
+		h.mu.Unlock()
+		h.sendTo(client, Message{Type: "error", Room: req.room, Content: "Too many subscriptions"})
+		return
+	}
+	sub := &subscription{client: client, room: req.room, since: req.since, uncount: metrics.ConnectionOpened(req.room)}
+	client.subs[req.room] = sub
+	if h.rooms[req.room] == nil {
+		h.rooms[req.room] = make(map[*Client]*subscription)
+	}
+	h.rooms[req.room][client] = sub
+	h.mu.Unlock()
+
+	client.log.Debug("Subscribed", "room", req.room)
+	h.sendTo(client, Message{Type: "join", Room: req.room, Content: "Welcome to room: " + req.room, Timestamp: now})
+	h.admit(sub)
+	if !sub.live && client.authenticated() {
+		h.sendTo(client, Message{Type: "error", Room: req.room, Content: "Not allowed to read this room"})
+	}
+}
+
+// unsubscribe drops a room from a client and confirms it
+func (h *Hub) unsubscribe(req subscribeRequest) {
+	h.mu.Lock()
+	sub := req.client.subs[req.room]
+	if sub != nil {
+		h.dropSubscription(sub)
+	}
+	h.mu.Unlock()
+
+	if sub == nil {
+		h.sendTo(req.client, Message{Type: "error", Room: req.room, Content: "Not subscribed"})
+		return
+	}
+	h.sendTo(req.client, Message{Type: "unsubscribed", Room: req.room, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// dropSubscription removes one subscription of a client. The caller must
+// hold h.mu.
+func (h *Hub) dropSubscription(sub *subscription) {
+	delete(sub.client.subs, sub.room)
+	roomClients := h.rooms[sub.room]
+	delete(roomClients, sub.client)
+	sub.uncount()
+	if len(roomClients) == 0 {
+		delete(h.rooms, sub.room)
+	}
+	h.markAbsent(sub)
+}
+
+// revokeSubscription drops a subscription the client lost read access to,
+// telling it why. A connection left without rooms is closed with
+// closeRoomForbidden, as single-room clients expect. The caller must hold h.mu.
+func (h *Hub) revokeSubscription(sub *subscription, code, reason string) {
+	client := sub.client
+	if len(client.subs) == 1 {
+		h.removeClient(client, websocket.FormatCloseMessage(closeRoomForbidden, reason))
+		return
+	}
+	h.dropSubscription(sub)
+	select {
+	case client.send <- marshal(Message{Type: "unsubscribed", Room: sub.room, Code: code, Content: reason, Timestamp: time.Now().Format(time.RFC3339)}):
+	default:
+	}
+}
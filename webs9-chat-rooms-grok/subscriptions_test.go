@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMultipleRooms(t *testing.T) {
+	owner, u := newUser(t), newUser(t)
+	room, other := newRoom(t, owner), newRoom(t, owner)
+	addMember(t, room, owner, u, "member")
+	addMember(t, other, owner, u, "member")
+	oc := dial(t, room, owner)
+	prev := oc.chat("before subscribing")
+
+	c := dial(t, publicRoom, u)
+	c.send(Message{Type: "subscribe", Room: room})
+	c.next("join")
+	c.message("before subscribing")
+	c.send(Message{Type: "subscribe", Room: other, Since: 1 << 40})
+	c.next("join")
+	c.next("replay")
+	c.send(Message{Type: "subscribe", Room: room})
+	if m := c.next("error"); m.Room != room || m.Content != "Already subscribed" {
+		t.Errorf("second subscribe: %+v", m)
+	}
+
+	// Frames name their room; the connection's room is the default
+	c.send(Message{Type: "message", Room: room, Content: "to the room", ClientMsgID: uniqueName("c")})
+	if m := oc.message("to the room"); m.Username != u.name || m.Seq != prev.Seq+1 {
+		t.Errorf("owner got %+v", m)
+	}
+	if m := c.chat("to public"); m.Room != publicRoom {
+		t.Errorf("ack for room %q, want %s", m.Room, publicRoom)
+	}
+
+	c.send(Message{Type: "unsubscribe", Room: room})
+	if m := c.next("unsubscribed"); m.Room != room {
+		t.Errorf("unsubscribed = %+v", m)
+	}
+	oc.chat("after unsubscribing")
+	c.none("message", 200*time.Millisecond)
+	c.send(Message{Type: "unsubscribe", Room: room})
+	if m := c.next("error"); m.Content != "Not subscribed" {
+		t.Errorf("second unsubscribe: %+v", m)
+	}
+
+	// Losing access to one room leaves the others open
+	if code, _ := api(t, "DELETE", "/rooms/"+other+"/members/"+u.name, owner.token, nil); code != http.StatusNoContent {
+		t.Fatalf("remove: %d", code)
+	}
+	if m := c.next("unsubscribed"); m.Room != other || m.Code != "forbidden" {
+		t.Errorf("removal: %+v", m)
+	}
+	if m := c.chat("still here"); m.Type != "ack" {
+		t.Errorf("message after removal from another room: %+v", m)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	c := dial(t, publicRoom, newUser(t))
+	// Rooms the user can't read count too; they may be invited later
+	for range maxSubscriptions - 1 {
+		c.send(Message{Type: "subscribe", Room: uniqueName("room")})
+		c.next("join")
+		c.next("error")
+	}
+	c.send(Message{Type: "subscribe", Room: uniqueName("room")})
+	if m := c.nextOf("join", "error"); m.Content != "Too many subscriptions" {
+		t.Errorf("subscription %d: %+v", maxSubscriptions+1, m)
+	}
+}
+
+// A client that can't keep up is dropped instead of holding up the room
+func TestSlowClientDropped(t *testing.T) {
+	h := newTestHub()
+	room := uniqueName("room")
+	fast, slow := testClient(h), testClient(h)
+	slow.send = make(chan []byte, 1)
+	h.rooms[room] = make(map[*Client]*subscription)
+	for _, c := range []*Client{fast, slow} {
+		sub := &subscription{client: c, room: room, live: true, uncount: func() {}}
+		c.subs[room] = sub
+		h.rooms[room][c] = sub
+	}
+
+	for _, content := range []string{"one", "two", "three"} {
+		h.deliverRoom(Message{Type: "message", Room: room, Content: content})
+	}
+	if !h.slow[slow] || h.slow[fast] {
+		t.Fatalf("slow clients = %v", h.slow)
+	}
+	h.dropSlow()
+	if h.clients[slow] || h.rooms[room][slow] != nil || len(h.slow) != 0 {
+		t.Error("slow client still registered")
+	}
+	if !slow.closed {
+		t.Error("slow client's send channel open")
+	}
+	if n := len(sent(t, fast)); n != 3 {
+		t.Errorf("fast client got %d messages, want 3", n)
+	}
+}
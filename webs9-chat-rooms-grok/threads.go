@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webs9-chat-db/store"
+)
+
+type threadRequest struct {
+	client *Client
+	room   string
+	root   int64 // 0 to unsubscribe
+}
+
+// lookupThreadRoot resolves a message to the root of its thread
+func lookupThreadRoot(id int64) (int64, string, error) {
+	m, err := messageStore.Get(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, "", errNoSuchMessage
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if m.ParentID != 0 {
+		// Replies to replies join the thread of the root
+		return m.ParentID, m.Room, nil
+	}
+	return id, m.Room, nil
+}
+
+// threadRoot validates the parent of a new message in room and returns the
+// thread root it belongs to, or 0 for a top-level message
+func threadRoot(parentID int64, room string) (int64, error) {
+	if parentID == 0 {
+		return 0, nil
+	}
+	root, parentRoom, err := lookupThreadRoot(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if parentRoom != room {
+		return 0, errNoSuchMessage
+	}
+	return root, nil
+}
+
+func threadErrorText(err error) string {
+	if errors.Is(err, errNoSuchMessage) {
+		return "No such parent message"
+	}
+	slog.Error("DB thread error", "err", err)
+	return "Internal error"
+}
+
+// threadPage is a thread root with the replies after a cursor. NextAfter is
+// the cursor for the following page, 0 once all replies were returned.
+type threadPage struct {
+	Root      Message   `json:"root"`
+	Replies   []Message `json:"replies"`
+	NextAfter int64     `json:"next_after,omitempty"`
+}
+
+func loadThread(root int64, room string, after int64, limit int) (threadPage, error) {
+	rootMsg, err := messageStore.Get(root)
+	if errors.Is(err, store.ErrNotFound) || err == nil && rootMsg.Room != room {
+		return threadPage{}, errNoSuchMessage
+	}
+	if err != nil {
+		return threadPage{}, err
+	}
+	stored, err := messageStore.Replies(root, after, limit)
+	if err != nil {
+		return threadPage{}, err
+	}
+	msgs, err := fromStoredWithReactions(append([]store.Message{rootMsg}, stored...))
+	if err != nil {
+		return threadPage{}, err
+	}
+
+	page := threadPage{Root: msgs[0], Replies: msgs[1:]}
+	if len(page.Replies) == limit {
+		page.NextAfter = page.Replies[limit-1].ID
+	}
+	return page, nil
+}
+
+// subscribeThread narrows a client's live delivery in a room to one thread,
+// sending the thread so far, or widens it back to the whole room
+func (h *Hub) subscribeThread(req threadRequest) {
+	client := req.client
+	sub := h.subscription(client, req.room)
+	if sub == nil {
+		h.sendTo(client, Message{Type: "error", Room: req.room, Content: "Not subscribed"})
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	if req.root == 0 {
+		sub.thread = 0
+		h.sendTo(client, Message{Type: "thread_unsubscribed", Room: sub.room, Timestamp: now})
+		return
+	}
+
+	if !sub.live {
+		h.sendTo(client, Message{Type: "error", Content: "Not allowed to read this room"})
+		return
+	}
+	root, room, err := lookupThreadRoot(req.root)
+	if err == nil && room != sub.room {
+		err = errNoSuchMessage
+	}
+	var page threadPage
+	if err == nil {
+		page, err = loadThread(root, room, 0, maxReplay)
+	}
+	if err != nil {
+		h.sendTo(client, Message{Type: "error", ID: req.root, Content: threadErrorText(err)})
+		return
+	}
+
+	sub.thread = root
+	h.sendTo(client, Message{
+		Type:      "thread",
+		ID:        root,
+		Room:      room,
+		Messages:  append([]Message{page.Root}, page.Replies...),
+		Timestamp: now,
+	})
+}
+
+// threadHandler serves GET /messages/{id}/thread?after=<id>&limit=N.
+// Threads in the public room need no token.
+func threadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	userID := ""
+	if r.Header.Get("Authorization") != "" {
+		s, err := sessionFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = s.userID
+	}
+
+	q := r.URL.Query()
+	var after int64
+	var limit int
+	if v := q.Get("after"); v != "" {
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	root, room, err := lookupThreadRoot(id)
+	if err == nil {
+		// Hide messages of rooms the caller can't read
+		if rl, roleErr := roleOf(room, userID); roleErr != nil || !rl.canRead() {
+			err = errNoSuchMessage
+		}
+	}
+	var page threadPage
+	if err == nil {
+		page, err = loadThread(root, room, after, pageSize(limit))
+	}
+	if errors.Is(err, errNoSuchMessage) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("DB thread error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
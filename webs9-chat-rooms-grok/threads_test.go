@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// reply sends a reply to parent and returns its ack
+func (c *wsClient) reply(parent int64, content string) Message {
+	c.t.Helper()
+	id := uniqueName("c")
+	c.send(Message{Type: "message", Room: c.room, Content: content, ParentID: parent, ClientMsgID: id})
+	for {
+		if m := c.nextOf("ack", "nack"); m.ClientMsgID == id {
+			return m
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	owner := newUser(t)
+	room := newRoom(t, owner)
+	c := dial(t, room, owner)
+	root := c.chat("root")
+	first := c.reply(root.ID, "first reply")
+	if first.Type != "ack" {
+		t.Fatalf("reply: %+v", first)
+	}
+	if m := c.message("first reply"); m.ParentID != root.ID {
+		t.Errorf("reply delivered with parent %d, want %d", m.ParentID, root.ID)
+	}
+
+	// Replies to replies join the root's thread
+	c.reply(first.ID, "nested")
+	if m := c.message("nested"); m.ParentID != root.ID {
+		t.Errorf("nested reply has parent %d, want the root %d", m.ParentID, root.ID)
+	}
+
+	msgs, _ := getMessagesBefore(room, 0, 3)
+	if msgs[0].ReplyCount != 2 {
+		t.Errorf("root has %d replies, want 2", msgs[0].ReplyCount)
+	}
+
+	other := dial(t, newRoom(t, owner), owner)
+	for _, parent := range []int64{1 << 40, other.chat("elsewhere").ID} {
+		if m := c.reply(parent, "lost"); m.Type != "nack" || m.Code != "invalid" {
+			t.Errorf("reply to %d: %+v, want an invalid nack", parent, m)
+		}
+	}
+}
+
+func TestThreadHandler(t *testing.T) {
+	owner, outsider := newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	c := dial(t, room, owner)
+	root := c.chat("root")
+	var replies []int64
+	for i := range 3 {
+		replies = append(replies, c.reply(root.ID, fmt.Sprint("reply ", i)).ID)
+	}
+
+	// Paging from any message of the thread
+	var got []int64
+	path := fmt.Sprintf("/messages/%d/thread?limit=2", replies[1])
+	for path != "" {
+		code, body := api(t, "GET", path, owner.token, nil)
+		var page threadPage
+		if code != http.StatusOK || json.Unmarshal(body, &page) != nil {
+			t.Fatalf("%s: %d %s", path, code, body)
+		}
+		if page.Root.ID != root.ID {
+			t.Errorf("root %d, want %d", page.Root.ID, root.ID)
+		}
+		for _, m := range page.Replies {
+			got = append(got, m.ID)
+		}
+		path = ""
+		if page.NextAfter != 0 {
+			path = fmt.Sprintf("/messages/%d/thread?limit=2&after=%d", root.ID, page.NextAfter)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(replies) {
+		t.Errorf("replies %v, want %v", got, replies)
+	}
+
+	threadPath := fmt.Sprintf("/messages/%d/thread", root.ID)
+	cases := []struct {
+		path, token string
+		want        int
+	}{
+		{"/messages/x/thread", owner.token, http.StatusBadRequest},
+		{threadPath + "?after=-1", owner.token, http.StatusBadRequest},
+		{threadPath, outsider.token, http.StatusNotFound},
+		{threadPath, "", http.StatusNotFound},
+		{fmt.Sprintf("/messages/%d/thread", 1<<40), owner.token, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if code, _ := api(t, "GET", tc.path, tc.token, nil); code != tc.want {
+			t.Errorf("GET %s: %d, want %d", tc.path, code, tc.want)
+		}
+	}
+}
+
+func TestSubscribeThread(t *testing.T) {
+	owner := newUser(t)
+	room := newRoom(t, owner)
+	c, watcher := dial(t, room, owner), dial(t, room, owner)
+	root := c.chat("root")
+	c.reply(root.ID, "before")
+
+	watcher.send(Message{Type: "subscribe_thread", Room: room, ID: root.ID})
+	m := watcher.next("thread")
+	if m.ID != root.ID || len(m.Messages) != 2 || m.Messages[1].Content != "before" {
+		t.Errorf("thread = %+v", m)
+	}
+
+	// Only the thread is delivered until the client widens delivery again
+	c.chat("elsewhere")
+	c.reply(root.ID, "after")
+	if m := watcher.next("message"); m.Content != "after" {
+		t.Errorf("thread subscriber got %q, want the reply", m.Content)
+	}
+	watcher.send(Message{Type: "unsubscribe_thread", Room: room})
+	watcher.next("thread_unsubscribed")
+	c.chat("whole room")
+	watcher.message("whole room")
+
+	watcher.send(Message{Type: "subscribe_thread", Room: room, ID: 1 << 40})
+	if m := watcher.nextOf("thread", "error"); m.Type != "error" {
+		t.Errorf("unknown thread: %+v", m)
+	}
+}
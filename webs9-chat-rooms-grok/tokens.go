@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"webs9-chat-db/logging"
+	"webs9-chat-db/metrics"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	// Application close code telling clients to refresh their token and reconnect
+	closeAuthExpired = 4001
+)
+
+var (
+	errTokenRevoked   = errors.New("token revoked")
+	errInvalidRefresh = errors.New("invalid refresh token")
+)
+
+// session is the identity a client proved with an access token
+type session struct {
+	userID   string
+	username string
+	jti      string
+	issued   time.Time
+	expires  time.Time
+}
+
+func (s *session) expired(now time.Time) bool {
+	return now.After(s.expires)
+}
+
+// revocations caches the jti of every revoked, not yet expired access token,
+// and when users last logged out everywhere: their tokens issued in an
+// earlier second are revoked as well
+var revocations = struct {
+	sync.RWMutex
+	jtis  map[string]time.Time
+	users map[string]time.Time
+}{jtis: make(map[string]time.Time), users: make(map[string]time.Time)}
+
+func loadRevocations() {
+	now := time.Now().Unix()
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at <= ?", now); err != nil {
+		slog.Error("DB purge revocations error", "err", err)
+	}
+	// Every token issued before these logouts has expired
+	if _, err := db.Exec("DELETE FROM user_logouts WHERE at <= ?", now-int64(accessTokenTTL.Seconds())); err != nil {
+		slog.Error("DB purge revocations error", "err", err)
+	}
+
+	rows, err := db.Query("SELECT jti, expires_at FROM revoked_tokens")
+	if err != nil {
+		logging.Fatal("Loading revocations", "err", err)
+	}
+	defer rows.Close()
+
+	revocations.Lock()
+	defer revocations.Unlock()
+	for rows.Next() {
+		var jti string
+		var exp int64
+		if err := rows.Scan(&jti, &exp); err != nil {
+			logging.Fatal("Loading revocations", "err", err)
+		}
+		revocations.jtis[jti] = time.Unix(exp, 0)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Fatal("Loading revocations", "err", err)
+	}
+
+	logouts, err := db.Query("SELECT user_id, at FROM user_logouts")
+	if err != nil {
+		logging.Fatal("Loading revocations", "err", err)
+	}
+	defer logouts.Close()
+	for logouts.Next() {
+		var userID string
+		var at int64
+		if err := logouts.Scan(&userID, &at); err != nil {
+			logging.Fatal("Loading revocations", "err", err)
+		}
+		revocations.users[userID] = time.Unix(at, 0)
+	}
+}
+
+func isRevoked(s *session) bool {
+	revocations.RLock()
+	defer revocations.RUnlock()
+	if _, ok := revocations.jtis[s.jti]; ok {
+		return true
+	}
+	logout, ok := revocations.users[s.userID]
+	return ok && s.issued.Before(logout)
+}
+
+func revokeAccessToken(s *session) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", s.jti, s.expires.Unix())
+	if err != nil {
+		return err
+	}
+
+	cacheRevokedToken(s.jti, s.expires)
+	hub.share(busEvent{Kind: busRevoke, JTI: s.jti, At: s.expires.Unix()})
+	hub.recheckSessions()
+	return nil
+}
+
+// cacheRevokedToken adds a token revoked on this node or another to the
+// cache, dropping the expired ones
+func cacheRevokedToken(jti string, expires time.Time) {
+	revocations.Lock()
+	defer revocations.Unlock()
+	now := time.Now()
+	revocations.jtis[jti] = expires
+	for jti, exp := range revocations.jtis {
+		if now.After(exp) {
+			delete(revocations.jtis, jti)
+		}
+	}
+}
+
+// cacheLogout adds a logout everywhere, on this node or another, to the
+// cache, dropping the ones older than any unexpired token
+func cacheLogout(userID string, at time.Time) {
+	revocations.Lock()
+	defer revocations.Unlock()
+	revocations.users[userID] = at
+	for id, at := range revocations.users {
+		if time.Since(at) > accessTokenTTL {
+			delete(revocations.users, id)
+		}
+	}
+}
+
+// revokeUserTokens revokes the access tokens userID was issued before now
+// and closes all of the user's connections. Tokens issued earlier in the
+// current second stay valid, so a login right after isn't refused.
+func revokeUserTokens(userID string) error {
+	now := time.Now().Truncate(time.Second)
+	_, err := db.Exec(`INSERT INTO user_logouts (user_id, at) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET at = excluded.at`, userID, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	cacheLogout(userID, now)
+	hub.share(busEvent{Kind: busRevoke, UserID: userID, At: now.Unix()})
+	hub.kick <- kickRequest{room: serverWide, userID: userID, code: "logged_out", reason: "logged out"}
+	return nil
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func issueTokens(user User) (tokenPair, error) {
+	now := time.Now()
+	access, err := keys.Sign(jwt.MapClaims{
+		"sub":      strconv.FormatInt(user.ID, 10),
+		"username": user.Username,
+		"jti":      randomToken(16),
+		"iat":      now.Unix(),
+		"exp":      now.Add(accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refresh := randomToken(32)
+	_, err = db.Exec("INSERT INTO refresh_tokens (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(refresh), user.ID, now.Add(refreshTokenTTL).Unix())
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+func parseAccessToken(tokenString string) (*session, error) {
+	token, err := jwt.Parse(tokenString, keys.Keyfunc, jwt.WithValidMethods(validSigningMethods))
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	userID, _ := claims.GetSubject()
+	username, _ := claims["username"].(string)
+	jti, _ := claims["jti"].(string)
+	iat, _ := claims.GetIssuedAt()
+	exp, _ := claims.GetExpirationTime()
+	if userID == "" || username == "" || jti == "" || iat == nil || exp == nil {
+		return nil, errors.New("missing claims")
+	}
+	s := &session{userID: userID, username: username, jti: jti, issued: iat.Time, expires: exp.Time}
+	if isRevoked(s) {
+		return nil, errTokenRevoked
+	}
+	return s, nil
+}
+
+// sessionFromRequest authenticates a REST call carrying "Authorization: Bearer <token>"
+func sessionFromRequest(r *http.Request) (*session, error) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errors.New("missing bearer token")
+	}
+	s, err := parseAccessToken(tokenString)
+	if err != nil {
+		metrics.AuthFailures.Inc()
+	}
+	return s, err
+}
+
+// rotateRefreshToken consumes a refresh token and returns its owner. Presenting
+// an already used token revokes every token of that user, since it means the
+// token leaked.
+func rotateRefreshToken(refresh string) (User, error) {
+	hash := hashToken(refresh)
+
+	var u User
+	var expiresAt int64
+	var revoked bool
+	err := db.QueryRow(`
+		SELECT u.id, u.username, t.expires_at, t.revoked
+		FROM refresh_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ?`, hash).Scan(&u.ID, &u.Username, &expiresAt, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errInvalidRefresh
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if revoked {
+		slog.Warn("Refresh token reuse, revoking all sessions", "user_id", u.ID)
+		if err := revokeRefreshTokens(u.ID); err != nil {
+			slog.Error("DB revoke error", "err", err)
+		}
+		return User{}, errInvalidRefresh
+	}
+	if time.Now().Unix() >= expiresAt {
+		return User{}, errInvalidRefresh
+	}
+
+	res, err := db.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE token_hash = ? AND revoked = 0", hash)
+	if err != nil {
+		return User{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Lost a race against a concurrent refresh with the same token
+		return User{}, errInvalidRefresh
+	}
+	return u, nil
+}
+
+func revokeRefreshToken(userID int64, refresh string) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE token_hash = ? AND user_id = ?", hashToken(refresh), userID)
+	return err
+}
+
+func revokeRefreshTokens(userID int64) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?", userID)
+	return err
+}
+
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := rotateRefreshToken(req.RefreshToken)
+	if errors.Is(err, errInvalidRefresh) {
+		metrics.AuthFailures.Inc()
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("Refresh error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, user)
+}
+
+// logoutHandler revokes the caller's access token together with the given
+// refresh token. With "all" set it revokes all of the user's tokens instead
+// and closes their connections.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.ParseInt(s.userID, 10, 64)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+		All          bool   `json:"all"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := revokeAccessToken(s); err != nil {
+		slog.Error("Logout error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case req.All:
+		err = revokeRefreshTokens(userID)
+		if err == nil {
+			err = revokeUserTokens(s.userID)
+		}
+	case req.RefreshToken != "":
+		err = revokeRefreshToken(userID, req.RefreshToken)
+	}
+	if err != nil {
+		slog.Error("Logout error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTokens(w http.ResponseWriter, user User) {
+	tokens, err := issueTokens(user)
+	if err != nil {
+		slog.Error("Token issue error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func refresh(t *testing.T, token string) (int, tokenPair) {
+	t.Helper()
+	code, body := api(t, "POST", "/token/refresh", "", map[string]string{"refresh_token": token})
+	var tokens tokenPair
+	if code == http.StatusOK {
+		if err := json.Unmarshal(body, &tokens); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, tokens
+}
+
+func TestRefreshRotation(t *testing.T) {
+	u := newUser(t)
+	first := login(t, u.name)
+
+	code, second := refresh(t, first.RefreshToken)
+	if code != http.StatusOK || second.AccessToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh = %d %+v, want a new pair", code, second)
+	}
+
+	// Reusing a rotated token means it leaked, so all of the user's refresh
+	// tokens are revoked
+	if code, _ := refresh(t, first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: %d, want 401", code)
+	}
+	if code, _ := refresh(t, second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse was detected: %d, want 401", code)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	u := newUser(t)
+	tokens := login(t, u.name)
+	c := dial(t, publicRoom, testUser{name: u.name, token: tokens.AccessToken})
+
+	if code, body := api(t, "POST", "/logout", tokens.AccessToken, map[string]string{"refresh_token": tokens.RefreshToken}); code != http.StatusNoContent {
+		t.Fatalf("logout: %d %s", code, body)
+	}
+	if ce := c.closed(); ce == nil || ce.Code != closeAuthExpired {
+		t.Errorf("socket closed with %v, want %d", ce, closeAuthExpired)
+	}
+	if code, _ := api(t, "GET", "/dms", tokens.AccessToken, nil); code != http.StatusUnauthorized {
+		t.Errorf("revoked access token: %d, want 401", code)
+	}
+	if code, _ := refresh(t, tokens.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("revoked refresh token: %d, want 401", code)
+	}
+	if code, _ := api(t, "GET", "/dms", u.token, nil); code != http.StatusOK {
+		t.Errorf("other session after logout: %d, want 200", code)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	u := newUser(t)
+	other := login(t, u.name)
+	c := dial(t, publicRoom, u)
+	// Tokens issued in the second of the logout stay valid
+	time.Sleep(time.Second)
+
+	if code, body := api(t, "POST", "/logout", other.AccessToken, map[string]bool{"all": true}); code != http.StatusNoContent {
+		t.Fatalf("logout all: %d %s", code, body)
+	}
+	c.closed()
+	if code, _ := api(t, "GET", "/dms", u.token, nil); code != http.StatusUnauthorized {
+		t.Errorf("access token issued before logout all: %d, want 401", code)
+	}
+	if code, _ := refresh(t, other.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh token after logout all: %d, want 401", code)
+	}
+	if fresh := login(t, u.name); fresh.AccessToken == "" {
+		t.Error("no login after logout all")
+	} else if code, _ := api(t, "GET", "/dms", fresh.AccessToken, nil); code != http.StatusOK {
+		t.Errorf("token issued after logout all: %d, want 200", code)
+	}
+}
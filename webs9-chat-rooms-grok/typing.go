@@ -0,0 +1,117 @@
+package main
+
+import "time"
+
+const (
+	// Least time between two "typing" events relayed for the same user
+	typingThrottle = 3 * time.Second
+	// Silence after which the hub announces typing_stopped
+	typingTimeout = 6 * time.Second
+)
+
+// typingEvent is a client starting or stopping to type. These travel on their
+// own channel and are dropped when it is full, so they never hold up chat
+// traffic on broadcast.
+type typingEvent struct {
+	client *Client
+	room   string
+	stop   bool
+}
+
+type typingState struct {
+	username string
+	relayed  time.Time
+	expires  time.Time
+}
+
+// typing hands a typing event to the hub without blocking
+func (c *Client) typing(room string, stop bool) {
+	select {
+	case hub.typing <- typingEvent{client: c, room: room, stop: stop}:
+	default:
+	}
+}
+
+func (h *Hub) handleTyping(ev typingEvent) {
+	s := ev.client.sess.Load()
+	sub := h.subscription(ev.client, ev.room)
+	if s == nil || sub == nil || !sub.live || !sub.role.canWrite() {
+		return
+	}
+
+	if ev.stop {
+		h.stopTyping(sub.room, s.userID)
+		return
+	}
+
+	now := time.Now()
+	users := h.typingUsers[sub.room]
+	if users == nil {
+		users = make(map[string]*typingState)
+		h.typingUsers[sub.room] = users
+	}
+	state := users[s.userID]
+	if state == nil {
+		state = &typingState{username: s.username}
+		users[s.userID] = state
+	}
+	state.expires = now.Add(typingTimeout)
+	if now.Sub(state.relayed) < typingThrottle {
+		return
+	}
+	state.relayed = now
+	h.fanOutEphemeral(Message{Type: "typing", Room: sub.room, Username: s.username, Timestamp: now.Format(time.RFC3339)}, s.userID)
+}
+
+// stopTyping clears a user's typing state and announces it, if they were typing
+func (h *Hub) stopTyping(room, userID string) {
+	state, ok := h.typingUsers[room][userID]
+	if !ok {
+		return
+	}
+	delete(h.typingUsers[room], userID)
+	if len(h.typingUsers[room]) == 0 {
+		delete(h.typingUsers, room)
+	}
+	h.fanOutEphemeral(Message{Type: "typing_stopped", Room: room, Username: state.username, Timestamp: time.Now().Format(time.RFC3339)}, userID)
+}
+
+func (h *Hub) expireTyping() {
+	now := time.Now()
+	for room, users := range h.typingUsers {
+		for userID, state := range users {
+			if now.After(state.expires) {
+				h.stopTyping(room, userID)
+			}
+		}
+	}
+}
+
+// fanOutEphemeral delivers an event to the live clients of its room except
+// the user it is about, on every node
+func (h *Hub) fanOutEphemeral(event Message, exceptUserID string) {
+	h.deliverEphemeral(event, exceptUserID)
+	h.share(busEvent{Kind: busEphemeral, Message: event, UserID: exceptUserID})
+}
+
+// deliverEphemeral delivers an event to the clients of this node. Clients
+// with a full buffer miss it instead of being dropped as they would for chat
+// messages.
+func (h *Hub) deliverEphemeral(event Message, exceptUserID string) {
+	data := marshal(event)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client, sub := range h.rooms[event.Room] {
+		if !sub.live {
+			continue
+		}
+		if s := client.sess.Load(); s != nil && s.userID == exceptUserID {
+			continue
+		}
+		select {
+		case client.send <- data:
+		default:
+		}
+	}
+}
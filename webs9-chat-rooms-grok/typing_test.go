@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTyping(t *testing.T) {
+	owner, u, reader := newUser(t), newUser(t), newUser(t)
+	room := newRoom(t, owner)
+	addMember(t, room, owner, u, "member")
+	addMember(t, room, owner, reader, "read-only")
+	oc, c, rc := dial(t, room, owner), dial(t, room, u), dial(t, room, reader)
+
+	c.send(Message{Type: "typing", Room: room})
+	if m := oc.next("typing"); m.Username != u.name || m.Room != room {
+		t.Errorf("typing = %+v", m)
+	}
+	c.none("typing", 100*time.Millisecond)
+
+	// Repeats within the throttle window aren't relayed
+	c.send(Message{Type: "typing", Room: room})
+	oc.none("typing", 100*time.Millisecond)
+
+	c.send(Message{Type: "typing_stopped", Room: room})
+	if m := oc.next("typing_stopped"); m.Username != u.name {
+		t.Errorf("typing_stopped = %+v", m)
+	}
+
+	// Sending a message ends typing
+	c.send(Message{Type: "typing", Room: room})
+	oc.next("typing")
+	c.chat("done typing")
+	oc.next("typing_stopped")
+
+	// Read-only members can't type
+	rc.send(Message{Type: "typing", Room: room})
+	oc.none("typing", 100*time.Millisecond)
+}
+
+func TestTypingExpires(t *testing.T) {
+	h := newTestHub()
+	room := uniqueName("room")
+	c := testClient(h)
+	c.sess.Store(&session{userID: "2", username: "bob"})
+	h.rooms[room] = map[*Client]*subscription{c: {client: c, room: room, live: true}}
+	h.typingUsers[room] = map[string]*typingState{
+		"1": {username: "alice", expires: time.Now().Add(-time.Second)},
+		"3": {username: "carol", expires: time.Now().Add(time.Minute)},
+	}
+
+	h.expireTyping()
+	frames := sent(t, c)
+	if len(frames) != 1 || frames[0].Type != "typing_stopped" || frames[0].Username != "alice" {
+		t.Errorf("expiry sent %+v, want alice's typing_stopped", frames)
+	}
+	if _, ok := h.typingUsers[room]["3"]; !ok {
+		t.Error("unexpired typing state dropped")
+	}
+}
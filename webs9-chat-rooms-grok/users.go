@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+
+	"webs9-chat-db/metrics"
+)
+
+const minPasswordLen = 8
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+	// Cost of new password hashes; tests lower it
+	bcryptCost = bcrypt.DefaultCost
+
+	// Compared against when a username doesn't exist so the response time
+	// doesn't reveal which usernames are registered
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+	errUsernameTaken      = errors.New("username already taken")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+type User struct {
+	ID       int64
+	Username string
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func createUser(username, password string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	res, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, string(hash))
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return User{}, errUsernameTaken
+		}
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return User{ID: id, Username: username}, nil
+}
+
+func authenticateUser(username, password string) (User, error) {
+	var u User
+	var hash string
+	err := db.QueryRow("SELECT id, username, password_hash FROM users WHERE username = ?", username).
+		Scan(&u.ID, &u.Username, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, errInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, errInvalidCredentials
+	}
+	return u, nil
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !usernamePattern.MatchString(creds.Username) {
+		http.Error(w, "Username must be 3-32 letters, digits, '_', '.' or '-'", http.StatusBadRequest)
+		return
+	}
+	if len(creds.Password) < minPasswordLen {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	// bcrypt silently ignores everything past 72 bytes
+	if len(creds.Password) > 72 {
+		http.Error(w, "Password must be at most 72 bytes", http.StatusBadRequest)
+		return
+	}
+
+	user, err := createUser(creds.Username, creds.Password)
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Register error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"id": user.ID, "username": user.Username})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := authenticateUser(creds.Username, creds.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		metrics.AuthFailures.Inc()
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("Login error", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, user)
+}
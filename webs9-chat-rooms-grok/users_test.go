@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	name := uniqueName("user")
+	cases := []struct {
+		creds credentials
+		want  int
+	}{
+		{credentials{Username: name, Password: testPassword}, http.StatusCreated},
+		{credentials{Username: name, Password: testPassword}, http.StatusConflict},
+		{credentials{Username: "ab", Password: testPassword}, http.StatusBadRequest},
+		{credentials{Username: "bad name", Password: testPassword}, http.StatusBadRequest},
+		{credentials{Username: uniqueName("user"), Password: "short"}, http.StatusBadRequest},
+		{credentials{Username: uniqueName("user"), Password: strings.Repeat("x", 73)}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if code, body := api(t, "POST", "/register", "", c.creds); code != c.want {
+			t.Errorf("register %q/%d-byte password: %d %s, want %d", c.creds.Username, len(c.creds.Password), code, body, c.want)
+		}
+	}
+
+	var hash string
+	if err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", name).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash == testPassword || !strings.HasPrefix(hash, "$2") {
+		t.Errorf("password stored as %q, want a bcrypt hash", hash)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	u := newUser(t)
+	if u.token == "" {
+		t.Fatal("login returned no token")
+	}
+	s, err := parseAccessToken(u.token)
+	if err != nil || s.username != u.name {
+		t.Errorf("token session = %+v, %v, want user %s", s, err, u.name)
+	}
+
+	for _, creds := range []credentials{
+		{Username: u.name, Password: "wrong-password"},
+		{Username: uniqueName("nobody"), Password: testPassword},
+	} {
+		if code, _ := api(t, "POST", "/login", "", creds); code != http.StatusUnauthorized {
+			t.Errorf("login %s with a bad password: %d, want 401", creds.Username, code)
+		}
+	}
+	if code, _ := api(t, "GET", "/login", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /login: %d, want 405", code)
+	}
+}
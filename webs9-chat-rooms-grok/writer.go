@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"webs9-chat-db/metrics"
+	"webs9-chat-db/store"
+)
+
+// How long a sender is told to wait when the write queue is full
+const writeRetryAfter = time.Second
+
+// messageWriter persists chat messages off the hub goroutine. The hub
+// queues messages; the writer stores them in batches, in queue order, with
+// the store assigning their IDs and seqs, and hands the results back to the
+// hub, which only then acks and delivers them. A room's messages therefore
+// reach clients in seq order and only once they are stored.
+type messageWriter struct {
+	store     store.MessageStore
+	batchSize int
+	delay     time.Duration // longest a message waits for its batch to fill
+
+	queue   chan Message
+	results chan []writeResult
+}
+
+// writeResult is the outcome of storing one message; on success the message
+// has its ID and seq set. A duplicate was stored before under its
+// client_msg_id and holds the stored copy instead.
+type writeResult struct {
+	message   Message
+	err       error
+	duplicate bool
+}
+
+// result builds the writeResult of m from its stored copy
+func result(m Message, stored store.Message, err error) writeResult {
+	if err != nil || !stored.Duplicate {
+		m.ID, m.Seq = stored.ID, stored.Seq
+		return writeResult{message: m, err: err}
+	}
+	dup := fromStored(stored)
+	dup.ClientMsgID, dup.from, dup.userID = m.ClientMsgID, m.from, m.userID
+	return writeResult{message: dup, duplicate: true}
+}
+
+func newMessageWriter(s store.MessageStore, batchSize int, delay time.Duration, queueSize int) *messageWriter {
+	return &messageWriter{
+		store:     s,
+		batchSize: max(batchSize, 1),
+		delay:     delay,
+		queue:     make(chan Message, queueSize),
+		results:   make(chan []writeResult, 16),
+	}
+}
+
+// enqueue queues a message without blocking and reports whether there was
+// room for it. Only the hub calls it.
+func (w *messageWriter) enqueue(m Message) bool {
+	select {
+	case w.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes batches until the queue is closed and drained, then closes
+// results
+func (w *messageWriter) run() {
+	defer close(w.results)
+	for {
+		first, ok := <-w.queue
+		if !ok {
+			return
+		}
+		batch := []Message{first}
+
+		timer := time.NewTimer(w.delay)
+	fill:
+		for len(batch) < w.batchSize {
+			select {
+			case m, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		w.results <- w.write(batch)
+	}
+}
+
+// write stores a batch in one transaction when the store supports it, and
+// one message at a time otherwise. A failed batch is retried one message at
+// a time too, so a bad message doesn't fail the others.
+func (w *messageWriter) write(batch []Message) []writeResult {
+	results := make([]writeResult, len(batch))
+	if ba, ok := w.store.(store.BatchAppender); ok && len(batch) > 1 {
+		stored := make([]store.Message, len(batch))
+		ptrs := make([]*store.Message, len(batch))
+		for i, m := range batch {
+			stored[i] = toStored(m)
+			ptrs[i] = &stored[i]
+		}
+		start := time.Now()
+		err := ba.AppendBatch(ptrs)
+		metrics.DBWriteSeconds.Observe(time.Since(start).Seconds())
+		if err == nil {
+			for i, m := range batch {
+				results[i] = result(m, stored[i], nil)
+			}
+			return results
+		}
+		slog.Warn("DB batch save error, saving one at a time", "batch", len(batch), "err", err)
+	}
+
+	for i, m := range batch {
+		stored := toStored(m)
+		start := time.Now()
+		err := w.store.Append(&stored)
+		metrics.DBWriteSeconds.Observe(time.Since(start).Seconds())
+		if err != nil {
+			slog.Error("DB save error", "err", err)
+		}
+		results[i] = result(m, stored, err)
+	}
+	return results
+}
+
+// close stops accepting messages; run finishes the queued ones first. Only
+// the hub calls it.
+func (w *messageWriter) close() {
+	close(w.queue)
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
-	"fmt"
+	"flag"
+	"log/slog"
 	"net/http"
+	"sort"
+	"time"
 	"ws-gemini/services"
 	"ws-gemini/types"
 
 	"github.com/gorilla/websocket"
+	"webs9-chat-db/logging"
+	"webs9-chat-db/metrics"
+	"webs9-chat-db/store"
 )
 
+// How many of the latest messages are replayed to new clients
+const historySize = 10
+
+var storeSpec = flag.String("store", "memory:10", "where chat history is kept: memory, memory:N (last N per room) or file:DIR")
+var logLevel = flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -17,10 +29,26 @@ var upgrader = websocket.Upgrader{
 var broadcast = make(chan types.Message)
 
 func main() {
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		logging.Fatal("Invalid -log-level", "err", err)
+	}
+
+	var err error
+	types.Messages, err = store.Open(*storeSpec)
+	if err != nil {
+		logging.Fatal("Opening message store", "err", err)
+	}
+
 	go handleMessages()
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 
+		// Every log line about this connection carries its ID; the URL is
+		// logged with the token masked
+		logger := slog.With("conn", logging.NextConnID(), "remote", r.RemoteAddr)
+		logger.Debug("Connection request", "url", logging.RedactURL(r.URL))
+
 		// Get "token" from query params: ?token=12345
 		queryParams := r.URL.Query()
 		token := queryParams.Get("token")
@@ -30,12 +58,16 @@ func main() {
 		if err != nil {
 			// If invalid, return 401 Unauthorized and STOP.
 			// Do NOT upgrade the connection.
+			metrics.AuthFailures.Inc()
+			logger.Warn("Invalid token", "err", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
+			metrics.UpgradeErrors.Inc()
+			logger.Warn("Upgrade error", "err", err)
 			return
 		}
 
@@ -45,26 +77,35 @@ func main() {
 			Send:     make(chan types.WSMessage, 256),
 			UserID:   userID,
 			Username: username,
+			Log:      logger.With("user", username),
 		}
 		// if !client.Isexist
 		client.AddtoPool()
 
 		// 2. Replay History
-		types.HistoryMu.Lock()
-		for _, oldMsg := range types.History {
-			// FIX: Use WriteJSON because oldMsg is a Struct now
-			conn.WriteJSON(oldMsg)
+		history, err := recentHistory()
+		if err != nil {
+			client.Log.Error("History error", "err", err)
+		}
+		for _, old := range history {
+			conn.WriteJSON(types.WSMessage{Type: old.Type, Content: old.Content, Sender: old.Username, Room: old.Room})
 		}
-		types.HistoryMu.Unlock()
 
-		fmt.Printf("Client connected. Total: %d\n", len(types.Clients))
-		fmt.Printf("Authenticated Client Connected: %s (%s)\n", username, userID)
+		client.Log.Info("Client connected", "user_id", userID, "room", queryParams.Get("room"), "total", len(types.Clients))
+		// No rooms here, and the room parameter is client input
+		defer metrics.ConnectionOpened("")()
+
 		go client.WritePump()
 		client.ReadPump(broadcast)
+		client.Log.Info("Client disconnected")
 	})
 
-	fmt.Println("Server started on :8080")
-	http.ListenAndServe(":8080", nil)
+	http.Handle("GET /metrics", metrics.Handler())
+
+	slog.Info("Server started", "addr", ":8080")
+	if err := http.ListenAndServe(":8080", nil); err != nil {
+		logging.Fatal("HTTP server error", "err", err)
+	}
 }
 
 func handleMessages() {
@@ -79,12 +120,9 @@ func handleMessages() {
 		payload.Sender = internalMsg.Client.Username
 
 		// 3. Save to History
-		types.HistoryMu.Lock()
-		types.History = append(types.History, payload)
-		if len(types.History) > 10 {
-			types.History = types.History[1:]
+		if err := saveMessage(internalMsg.Client, payload); err != nil {
+			internalMsg.Client.Log.Error("History error", "err", err)
 		}
-		types.HistoryMu.Unlock()
 
 		// 4. Broadcast
 		types.ClientsMu.Lock()
@@ -97,6 +135,8 @@ func handleMessages() {
 			select {
 			case client.Send <- payload:
 			default:
+				metrics.SendDrops.Inc()
+				client.Log.Warn("Send buffer full, dropping client")
 				close(client.Send)
 				delete(types.Clients, client.UserID)
 			}
@@ -104,3 +144,41 @@ func handleMessages() {
 		types.ClientsMu.Unlock()
 	}
 }
+
+// recentHistory returns the last historySize messages of all rooms, oldest
+// first, as every client gets the messages of every room
+func recentHistory() ([]store.Message, error) {
+	rooms := []string{""}
+	if lister, ok := types.Messages.(store.Purger); ok {
+		var err error
+		if rooms, err = lister.Rooms(); err != nil {
+			return nil, err
+		}
+	}
+
+	var history []store.Message
+	for _, room := range rooms {
+		msgs, err := types.Messages.Before(room, 0, historySize)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, msgs...)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].ID < history[j].ID })
+	return history[max(0, len(history)-historySize):], nil
+}
+
+// saveMessage stores a broadcast payload as the next message of its room;
+// the store assigns its seq.
+func saveMessage(client *types.Client, payload types.WSMessage) error {
+	start := time.Now()
+	defer func() { metrics.DBWriteSeconds.Observe(time.Since(start).Seconds()) }()
+	return types.Messages.Append(&store.Message{
+		Type:      payload.Type,
+		Room:      payload.Room,
+		UserID:    client.UserID,
+		Username:  payload.Sender,
+		Content:   payload.Content,
+		Timestamp: time.Now().UTC(),
+	})
+}
@@ -2,9 +2,12 @@ package types
 
 import (
 	"encoding/json"
+	"log/slog"
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"webs9-chat-db/metrics"
+	"webs9-chat-db/store"
 )
 
 type Client struct {
@@ -13,14 +16,15 @@ type Client struct {
 	UserID   string
 	Username string
 	Rooms    map[*Room]bool // Track which rooms I am in
+	Log      *slog.Logger   // Tagged with the connection ID
 }
 
 var (
 	Clients   = make(map[string]*Client)
 	ClientsMu sync.Mutex
 
-	History   []WSMessage
-	HistoryMu sync.Mutex
+	// Chat history, opened in main
+	Messages store.MessageStore
 )
 
 func (client *Client) AddtoPool() {
@@ -46,8 +50,10 @@ func (c *Client) WritePump() {
 		}
 		// WriteJSON automatically converts the struct to {"type":"...", "content":"..."}
 		if err := c.Conn.WriteJSON(msg); err != nil {
+			c.Log.Debug("Write error", "err", err)
 			return
 		}
+		metrics.MessagesOut.Inc()
 	}
 }
 
@@ -68,13 +74,16 @@ func (c *Client) ReadPump(broadcast chan Message) {
 			// If the socket closed or network failed, stop the loop.
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				// Log only real network errors
+				c.Log.Warn("Unexpected close error", "err", err)
 			}
 			break // <--- FATAL ERROR: Kill connection
 		}
+		metrics.MessagesIn.Inc()
 
 		// STEP 2: Try to parse the JSON (Data Check)
 		var incoming WSMessage
 		if err := json.Unmarshal(rawMessage, &incoming); err != nil {
+			c.Log.Debug("Invalid JSON", "err", err)
 			// NON-FATAL ERROR: The user sent garbage (e.g., plain text)
 			// We just log it and ignore this specific message.
 			// We do NOT break the loop.
@@ -86,6 +95,8 @@ func (c *Client) ReadPump(broadcast chan Message) {
 			continue // <--- Skip to next message, keep connection alive!
 		}
 
+		c.Log.Debug("Message received", "type", incoming.Type, "room", incoming.Room)
+
 		// STEP 3: Success! Send to Hub
 		broadcast <- Message{
 			Client:  c,
@@ -0,0 +1,7 @@
+package types
+
+// Room is a chat room a client is in. Clients don't join rooms yet: every
+// message goes to every client, and Room only names the room it was sent to.
+type Room struct {
+	Name string
+}